@@ -1,24 +1,96 @@
 package db
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/averitas/courier_go/tools/logger"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-type Cdb struct {
-	*gorm.DB
-}
+// name of database dialects, same as gorm.Dialector.Name()
+const (
+	DialectMySQL    = "mysql"
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite"
+)
 
-var (
-	Db *Cdb
+const (
+	minConnectDelay = time.Second
+	maxConnectDelay = 10 * time.Second
 )
 
-func InitDb(dsn string) {
-	gdb, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+// connection pool and startup retry of database, zero value fields use defaults of database/sql
+type Options struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// keep retrying to connect in this duration, e.g. database is still booting.
+	// Connect only once if 0
+	ConnectTimeout time.Duration
+}
+
+// @description connect to database chosen by scheme of dsn:
+// postgres:// or postgresql:// for PostgreSQL, sqlite:// for SQLite file
+// (e.g. sqlite://courier.db or sqlite://file::memory:?cache=shared),
+// otherwise MySQL dsn with optional mysql:// prefix.
+// Failed connection is retried with backoff until options.ConnectTimeout.
+// @param dsn string
+// @param options *Options nil for defaults
+// @return *gorm.DB
+// @return error
+func InitDb(dsn string, options *Options) (*gorm.DB, error) {
+	if options == nil {
+		options = &Options{}
+	}
+
+	deadline := time.Now().Add(options.ConnectTimeout)
+	delay := minConnectDelay
+	var gdb *gorm.DB
+	var err error
+	for {
+		gdb, err = gorm.Open(Open(dsn), &gorm.Config{})
+		if err == nil {
+			break
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("connect to database error: %v", err)
+		}
+		logger.WarningLogger.Printf("connect to database error: %v, retry in %v\n", err, delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxConnectDelay {
+			delay = maxConnectDelay
+		}
+	}
+
+	sqlDb, err := gdb.DB()
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("get connection pool error: %v", err)
+	}
+	if options.MaxOpenConns > 0 {
+		sqlDb.SetMaxOpenConns(options.MaxOpenConns)
+	}
+	if options.MaxIdleConns > 0 {
+		sqlDb.SetMaxIdleConns(options.MaxIdleConns)
 	}
-	Db = &Cdb{
-		DB: gdb,
+	if options.ConnMaxLifetime > 0 {
+		sqlDb.SetConnMaxLifetime(options.ConnMaxLifetime)
+	}
+	return gdb, nil
+}
+
+// Open return dialector of dsn, see InitDb for supported schemes
+func Open(dsn string) gorm.Dialector {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return postgres.Open(dsn)
+	case strings.HasPrefix(dsn, "sqlite://"):
+		return sqlite.Open(strings.TrimPrefix(dsn, "sqlite://"))
+	default:
+		return mysql.Open(strings.TrimPrefix(dsn, "mysql://"))
 	}
 }
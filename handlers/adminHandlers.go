@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/averitas/courier_go/tools"
+	"github.com/gin-gonic/gin"
+)
+
+// @description http handler that list circuit breaker state of every courier
+// example: GET http://127.0.0.1:8080/api/admin/breakers
+// @param ctx *gin.Context
+// @return
+func (s *ServerHandler) ListBreakers(ctx *gin.Context) {
+	if s.HttpClient == nil {
+		ctx.JSON(http.StatusOK, []tools.BreakerStatus{})
+		return
+	}
+	ctx.JSON(http.StatusOK, s.HttpClient.BreakerStatus())
+}
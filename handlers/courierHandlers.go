@@ -16,9 +16,17 @@ import (
 type CourierHandler struct {
 	OrderService *services.OrderService
 
+	// done when worker is stopping, orders cooking are left to be resumed after restart
 	Ctx context.Context
 }
 
+func (c *CourierHandler) context() context.Context {
+	if c.Ctx == nil {
+		return context.Background()
+	}
+	return c.Ctx
+}
+
 // @description http handler that receive message from
 // apiserver "matched" type order
 // @param ctx *gin.Context
@@ -38,7 +46,8 @@ func (c *CourierHandler) SendOrder(ctx *gin.Context) {
 		return
 	}
 	go func() {
-		err := c.OrderService.WaitUntilOrderCooked(orderModel)
+		// request context is done after response, cook with worker context instead
+		err := c.OrderService.WaitUntilOrderCooked(c.context(), orderModel)
 		if err != nil {
 			logger.ErrorLogger.Printf("order :[%s] cook error :%v\n", orderModel.OrderId, err)
 		}
@@ -47,8 +56,9 @@ func (c *CourierHandler) SendOrder(ctx *gin.Context) {
 }
 
 // @description Ths function is used in queue receiver handler.
-// it deserilize message, start a goroutine wait dish is ready,
-// then set its status to finished.
+// it deserilize message, wait dish is ready, then set its status to finished.
+// It returns after cooking finished, so message is acked only when order is done,
+// or when worker is stopping, then order is left cooking and resumed after restart.
 // @param b []byte message body
 // @return error
 func (c *CourierHandler) HandleMessage(b []byte) error {
@@ -66,12 +76,39 @@ func (c *CourierHandler) HandleMessage(b []byte) error {
 	}
 
 	// start to cook
-	go func() {
-		err := c.OrderService.WaitUntilOrderCooked(orderModel)
-		if err != nil {
-			logger.ErrorLogger.Printf("[ERROR] Order :[%v] cook error :%v\n", orderModel, err)
-		}
-	}()
+	err = c.OrderService.WaitUntilOrderCooked(c.context(), orderModel)
+	if err != nil {
+		logger.ErrorLogger.Printf("[ERROR] Order :[%v] cook error :%v\n", orderModel, err)
+		return err
+	}
 
 	return nil
 }
+
+// @description http handler that receive cancellation of
+// "matched" type order from apiserver
+// @param ctx *gin.Context
+// @return
+func (c *CourierHandler) CancelOrder(ctx *gin.Context) {
+	id := ctx.Param("id")
+	if c.OrderService.Kitchen.Cancel(id) {
+		logger.InfoLogger.Printf("Order [%s] cancelled while cooking\n", id)
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// @description Ths function is used in cancel queue receiver handler.
+// it deserilize cancel message and stop cooking the order.
+// @param b []byte message body
+// @return error
+func (c *CourierHandler) HandleCancelMessage(b []byte) error {
+	var message *types.CancelOrder = &types.CancelOrder{}
+	err := json.Unmarshal(b, &message)
+	if err != nil {
+		return fmt.Errorf("unmarshal cancel message: [%s], error: %v", string(b), err)
+	}
+	if c.OrderService.Kitchen.Cancel(message.Id) {
+		logger.InfoLogger.Printf("Order [%s] cancelled while cooking\n", message.Id)
+	}
+	return nil
+}
@@ -1,18 +1,40 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/averitas/courier_go/models"
+	"github.com/averitas/courier_go/repository"
 	"github.com/averitas/courier_go/services"
+	"github.com/averitas/courier_go/tools"
 	"github.com/averitas/courier_go/tools/logger"
 	"github.com/averitas/courier_go/types"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+
+	idempotencyKeyHeader = "Idempotency-Key"
+	// gin context key of Idempotency-Key being processed
+	idempotencyKeyCtx = "idempotencyKey"
 )
 
 type ServerHandler struct {
 	OrderService *services.OrderService
+	// remember responses of requests with Idempotency-Key header, disabled if not set
+	Idempotency *services.IdempotencyService
+	// client used to call couriers, its breakers are shown by admin api
+	HttpClient *tools.ResilientHttpClient
 
 	Ctx context.Context
 }
@@ -22,38 +44,11 @@ type ServerHandler struct {
 // @param ctx *gin.Context
 // @return
 func (s *ServerHandler) ReceiveOrder(ctx *gin.Context) {
-	var requestJson []*types.Order
 	logger.InfoLogger.Printf("Start to find a random courier\n")
-	retval := &types.Message{
-		Code:    types.CodeSuccess,
-		Message: "received",
-	}
-	if err := ctx.BindJSON(&requestJson); err != nil {
-		retval.Code = types.CodeFailed
-		retval.Message = fmt.Sprintf("input json format err: %v", err)
-		ctx.JSON(http.StatusBadRequest, retval)
-		return
-	}
-	for i := 0; i < len(requestJson); i++ {
-		logger.InfoLogger.Printf("save order: %v to DB\n", *requestJson[i])
-		requestJson[i].OrderType = types.OrderTypeMatch
-		err := s.OrderService.SaveOrder(requestJson[i])
-		if err != nil {
-			retval.Code = types.CodeFailed
-			retval.Message = fmt.Sprintf("save order to db error: %v", err)
-			ctx.JSON(http.StatusInternalServerError, retval)
-			return
-		}
-		logger.InfoLogger.Printf("Start to call random courier api: %v\n", *requestJson[i])
-		err = s.OrderService.CallRandomCourierAPI(requestJson[i])
-		if err != nil {
-			retval.Code = types.CodeFailed
-			retval.Message = fmt.Sprintf("save order to db error: %v", err)
-			ctx.JSON(http.StatusInternalServerError, retval)
-			return
-		}
-	}
-	ctx.JSON(http.StatusAccepted, "received")
+	s.receiveOrders(ctx, types.OrderTypeMatch, func(order *types.Order) error {
+		logger.InfoLogger.Printf("Start to call random courier api: %v\n", *order)
+		return s.OrderService.CallRandomCourierAPI(order)
+	})
 }
 
 // @description http handler that user can call it
@@ -61,37 +56,212 @@ func (s *ServerHandler) ReceiveOrder(ctx *gin.Context) {
 // @param ctx *gin.Context
 // @return
 func (s *ServerHandler) ReceiveOrderFIFO(ctx *gin.Context) {
-	var requestJson []*types.Order
-	if err := ctx.BindJSON(&requestJson); err != nil {
-		ctx.String(http.StatusBadRequest, err.Error())
+	s.receiveOrders(ctx, types.OrderTypeFIFO, func(order *types.Order) error {
+		logger.InfoLogger.Printf("send message to queue: %v\n", *order)
+		return s.OrderService.SendOrderMessage(order)
+	})
+}
+
+// save and dispatch every order of posted batch. Each order gets its own result,
+// an order rejected doesn't stop others, so caller knows which orders are accepted.
+func (s *ServerHandler) receiveOrders(ctx *gin.Context, orderType string, dispatch func(*types.Order) error) {
+	// orders are decoded one by one so an invalid order only rejects itself
+	var requestJson []json.RawMessage
+	if err := ctx.ShouldBindBodyWith(&requestJson, binding.JSON); err != nil {
+		ctx.JSON(http.StatusBadRequest, &types.Message{
+			Code:    types.CodeFailed,
+			Message: fmt.Sprintf("input json format err: %v", err),
+		})
 		return
 	}
-	retval := &types.Message{
+	if !s.beginIdempotent(ctx) {
+		return
+	}
+
+	results := make([]*types.OrderResult, 0, len(requestJson))
+	rejected := 0
+	// batch with server errors is not remembered, so it could be retried with same key
+	remember := true
+	for _, raw := range requestJson {
+		result := s.receiveOrder(raw, orderType, dispatch)
+		if !result.Accepted {
+			rejected++
+			remember = remember && result.ErrorCode == types.OrderErrInvalid
+		}
+		results = append(results, result)
+	}
+
+	retval := &types.SubmitResult{
 		Code:    types.CodeSuccess,
 		Message: "received",
+		Orders:  results,
 	}
-	for i := 0; i < len(requestJson); i++ {
-		logger.InfoLogger.Printf("save order: %v to DB\n", *requestJson[i])
-		requestJson[i].OrderType = types.OrderTypeFIFO
-		err := s.OrderService.SaveOrder(requestJson[i])
-		if err != nil {
-			retval.Code = types.CodeFailed
-			retval.Message = fmt.Sprintf("save order to db error: %v", err)
-			ctx.JSON(http.StatusInternalServerError, retval)
-			return
+	status := http.StatusAccepted
+	if rejected > 0 {
+		retval.Code = types.CodeFailed
+		retval.Message = fmt.Sprintf("%d of %d orders rejected", rejected, len(results))
+		status = http.StatusMultiStatus
+	}
+	s.respond(ctx, status, retval, remember)
+}
+
+func (s *ServerHandler) receiveOrder(raw json.RawMessage, orderType string, dispatch func(*types.Order) error) *types.OrderResult {
+	order := &types.Order{}
+	if err := json.Unmarshal(raw, order); err != nil {
+		return rejectOrder(order, types.OrderErrInvalid, fmt.Errorf("input json format err: %v", err))
+	}
+	if err := binding.Validator.ValidateStruct(order); err != nil {
+		return rejectOrder(order, types.OrderErrInvalid, err)
+	}
+	order.OrderType = orderType
+
+	logger.InfoLogger.Printf("save order: %v to DB\n", *order)
+	orderModel, created, err := s.OrderService.SaveOrder(order)
+	if err != nil {
+		return rejectOrder(order, types.OrderErrSave, fmt.Errorf("save order to db error: %v", err))
+	}
+	// order with same id is dispatched again only if it never was, or its dispatch failed
+	retry := !created && orderModel.OrderStatus == models.OrderFailed
+	if !created && !retry && orderModel.OrderStatus != models.OrderStarted {
+		return newOrderResult(orderModel, true)
+	}
+
+	var invalid *models.InvalidTransitionError
+	if retry {
+		retried, err := s.OrderService.RetryDispatch(orderModel)
+		if errors.As(err, &invalid) {
+			// another request with same id retried it just now
+			orderModel.OrderStatus = invalid.From
+			return newOrderResult(orderModel, true)
+		} else if err != nil {
+			result := rejectOrder(order, types.OrderErrSave, fmt.Errorf("set order status error: %v", err))
+			result.OrderId = orderModel.OrderId
+			return result
+		} else if !retried {
+			result := rejectOrder(order, types.OrderErrInvalid, fmt.Errorf("order [%s] failed while cooking, submit it with a new id", orderModel.OrderId))
+			result.OrderId = orderModel.OrderId
+			result.Status = orderModel.OrderStatus.String()
+			return result
+		}
+	}
+	// outbox relay dispatches it when it's time to cook
+	if s.OrderService.IsScheduled(orderModel) {
+		logger.InfoLogger.Printf("order [%s] is scheduled at %v\n", orderModel.OrderId, orderModel.ScheduledAt)
+		return newOrderResult(orderModel, !created)
+	}
+
+	if !retry {
+		err = s.OrderService.TransitionOrder(orderModel, models.OrderDispatched)
+		if errors.As(err, &invalid) {
+			// another request with same id dispatched it just now
+			orderModel.OrderStatus = invalid.From
+			return newOrderResult(orderModel, true)
+		} else if err != nil {
+			result := rejectOrder(order, types.OrderErrSave, fmt.Errorf("set order status error: %v", err))
+			result.OrderId = orderModel.OrderId
+			return result
 		}
+	}
 
-		logger.InfoLogger.Printf("send message to queue: %v\n", *requestJson[i])
-		err = s.OrderService.SendOrderMessage(requestJson[i])
-		if err != nil {
-			retval.Code = types.CodeFailed
-			retval.Message = fmt.Sprintf("send message error: %v", err)
-			ctx.JSON(http.StatusInternalServerError, retval)
-			return
+	if err = dispatch(order); err != nil {
+		s.failOrder(orderModel)
+		s.OrderService.CloseOutbox(orderModel, false)
+		result := rejectOrder(order, types.OrderErrDispatch, fmt.Errorf("dispatch order error: %v", err))
+		result.OrderId = orderModel.OrderId
+		result.Status = orderModel.OrderStatus.String()
+		return result
+	}
+	s.OrderService.CloseOutbox(orderModel, true)
+	return newOrderResult(orderModel, !created)
+}
+
+func newOrderResult(orderModel *models.OrderModel, duplicate bool) *types.OrderResult {
+	return &types.OrderResult{
+		Id:        orderModel.Id,
+		OrderId:   orderModel.OrderId,
+		Status:    orderModel.OrderStatus.String(),
+		Duplicate: duplicate,
+		Accepted:  true,
+	}
+}
+
+func rejectOrder(order *types.Order, errorCode string, err error) *types.OrderResult {
+	logger.ErrorLogger.Printf("order [%s] rejected: %v\n", order.Id, err)
+	return &types.OrderResult{
+		Id:        order.Id,
+		Accepted:  false,
+		ErrorCode: errorCode,
+		Error:     err.Error(),
+	}
+}
+
+// start processing request with Idempotency-Key header, if the same request was
+// processed its response is replayed. Return false if response is already written.
+func (s *ServerHandler) beginIdempotent(ctx *gin.Context) bool {
+	key := ctx.GetHeader(idempotencyKeyHeader)
+	if len(key) == 0 || s.Idempotency == nil {
+		return true
+	}
+
+	var request bytes.Buffer
+	request.WriteString(ctx.Request.Method + " " + ctx.Request.URL.Path + "\n")
+	if body, ok := ctx.Get(gin.BodyBytesKey); ok {
+		request.Write(body.([]byte))
+	}
+
+	record, err := s.Idempotency.Begin(key, request.Bytes())
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrIdempotencyKeyInProgress) {
+			status = http.StatusConflict
+		} else if errors.Is(err, services.ErrIdempotencyKeyReused) {
+			status = http.StatusUnprocessableEntity
 		}
+		ctx.JSON(status, &types.Message{
+			Code:    types.CodeFailed,
+			Message: err.Error(),
+		})
+		return false
+	}
+	if record != nil {
+		logger.InfoLogger.Printf("replay response of Idempotency-Key [%s]\n", key)
+		ctx.Header("Idempotent-Replayed", "true")
+		ctx.Data(record.StatusCode, "application/json; charset=utf-8", []byte(record.Response))
+		return false
 	}
+	ctx.Set(idempotencyKeyCtx, key)
+	return true
+}
+
+// write json response and remember it for the Idempotency-Key of request.
+// Response not remembered could be retried by client with same key.
+func (s *ServerHandler) respond(ctx *gin.Context, code int, body interface{}, remember bool) {
+	ctx.JSON(code, body)
+
+	key := ctx.GetString(idempotencyKeyCtx)
+	if len(key) == 0 {
+		return
+	}
+	if !remember {
+		s.Idempotency.Abort(key)
+		return
+	}
+	response, err := json.Marshal(body)
+	if err == nil {
+		err = s.Idempotency.Finish(key, code, response)
+	}
+	if err != nil {
+		logger.ErrorLogger.Printf("save response of Idempotency-Key [%s] error: %v\n", key, err)
+		s.Idempotency.Abort(key)
+	}
+}
 
-	ctx.JSON(http.StatusAccepted, retval)
+// order couldn't be dispatched, move it to failed so it's not stuck
+func (s *ServerHandler) failOrder(orderModel *models.OrderModel) {
+	err := s.OrderService.TransitionOrder(orderModel, models.OrderFailed)
+	if err != nil {
+		logger.ErrorLogger.Printf("set order [%s] status to failed error: %v\n", orderModel.OrderId, err)
+	}
 }
 
 // @description http handler that user can call it
@@ -118,6 +288,249 @@ func (s *ServerHandler) QueryAverageDelay(ctx *gin.Context) {
 		ctx.JSON(http.StatusInternalServerError, retval)
 		return
 	}
-	retval.Message = fmt.Sprintf("Average dispatch delay is %v", average*1000)
-	ctx.JSON(http.StatusOK, retval)
+	byPriority, err := s.OrderService.GetAverageDelayByPriority(orderType)
+	if err != nil {
+		retval.Code = types.CodeFailed
+		retval.Message = fmt.Sprintf("query average by priority error: %v", err)
+		ctx.JSON(http.StatusInternalServerError, retval)
+		return
+	}
+	for priority, delay := range byPriority {
+		byPriority[priority] = delay * 1000
+	}
+	byPhase, err := s.OrderService.GetAverageDelayByPhase(orderType)
+	if err != nil {
+		retval.Code = types.CodeFailed
+		retval.Message = fmt.Sprintf("query average by phase error: %v", err)
+		ctx.JSON(http.StatusInternalServerError, retval)
+		return
+	}
+	for phase, delay := range byPhase {
+		byPhase[phase] = delay * 1000
+	}
+	ctx.JSON(http.StatusOK, &types.DelayResult{
+		Code:       types.CodeSuccess,
+		Message:    fmt.Sprintf("Average dispatch delay is %v", average*1000),
+		ByPriority: byPriority,
+		ByPhase:    byPhase,
+	})
+}
+
+// @description http handler that user can call it
+// to retrieve pickup delay statistics(in milliseconds) of requested type:
+// count, mean, percentiles, max and histogram. Query parameters from and to (RFC3339)
+// limit finish time of orders, groupBy=minute|hour also returns statistics of each time bucket,
+// it requires from and at most 1440 buckets
+// example: GET http://127.0.0.1:8080/api/delay/fifo/stats?from=2022-11-20T10:00:00Z&groupBy=minute
+// @param ctx *gin.Context
+// @return
+func (s *ServerHandler) QueryDelayStats(ctx *gin.Context) {
+	var from, to time.Time
+	var err error
+	if value := ctx.Query("from"); len(value) > 0 {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			ctx.JSON(http.StatusBadRequest, &types.Message{
+				Code:    types.CodeFailed,
+				Message: fmt.Sprintf("from [%s] is invalid: %v", value, err),
+			})
+			return
+		}
+	}
+	if value := ctx.Query("to"); len(value) > 0 {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			ctx.JSON(http.StatusBadRequest, &types.Message{
+				Code:    types.CodeFailed,
+				Message: fmt.Sprintf("to [%s] is invalid: %v", value, err),
+			})
+			return
+		}
+	}
+
+	stats, err := s.OrderService.GetDelayStats(ctx.Param("orderType"), from, to, ctx.Query("groupBy"))
+	if errors.Is(err, services.ErrInvalidDelayQuery) {
+		ctx.JSON(http.StatusBadRequest, &types.Message{
+			Code:    types.CodeFailed,
+			Message: err.Error(),
+		})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, &types.Message{
+			Code:    types.CodeFailed,
+			Message: fmt.Sprintf("query delay stats error: %v", err),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, stats)
+}
+
+// @description http handler that user can call it
+// to query status of an order by the id user sent
+// example: GET http://127.0.0.1:8080/api/orders/{id}
+// @param ctx *gin.Context
+// @return
+func (s *ServerHandler) QueryOrder(ctx *gin.Context) {
+	id := ctx.Param("id")
+	detail, err := s.OrderService.GetOrderDetail(id)
+	if errors.Is(err, repository.ErrOrderNotFound) {
+		ctx.JSON(http.StatusNotFound, &types.Message{
+			Code:    types.CodeFailed,
+			Message: fmt.Sprintf("order [%s] not found", id),
+		})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, &types.Message{
+			Code:    types.CodeFailed,
+			Message: fmt.Sprintf("query order error: %v", err),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, detail)
+}
+
+// @description http handler that user can call it
+// to cancel an order by the id user sent
+// example: POST http://127.0.0.1:8080/api/orders/{id}/cancel
+// @param ctx *gin.Context
+// @return
+func (s *ServerHandler) CancelOrder(ctx *gin.Context) {
+	id := ctx.Param("id")
+	err := s.OrderService.CancelOrder(id)
+	if errors.Is(err, repository.ErrOrderNotFound) {
+		ctx.JSON(http.StatusNotFound, &types.Message{
+			Code:    types.CodeFailed,
+			Message: fmt.Sprintf("order [%s] not found", id),
+		})
+		return
+	}
+	var invalid *models.InvalidTransitionError
+	if errors.As(err, &invalid) {
+		ctx.JSON(http.StatusConflict, &types.Message{
+			Code:    types.CodeFailed,
+			Message: fmt.Sprintf("order [%s] error: %v", id, err),
+		})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, &types.Message{
+			Code:    types.CodeFailed,
+			Message: fmt.Sprintf("cancel order error: %v", err),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, &types.Message{
+		Code:    types.CodeSuccess,
+		Message: "cancelled",
+	})
+}
+
+// @description http handler that courier call it after picking up
+// a finished order, order status is moved to picked_up
+// example: POST http://127.0.0.1:8080/api/orders/{id}/pickup
+// @param ctx *gin.Context
+// @return
+func (s *ServerHandler) PickUpOrder(ctx *gin.Context) {
+	s.advanceOrder(ctx, s.OrderService.PickUpOrder, "picked up")
+}
+
+// @description http handler that courier call it after delivering
+// a picked up order, order status is moved to delivered
+// example: POST http://127.0.0.1:8080/api/orders/{id}/deliver
+// @param ctx *gin.Context
+// @return
+func (s *ServerHandler) DeliverOrder(ctx *gin.Context) {
+	s.advanceOrder(ctx, s.OrderService.DeliverOrder, "delivered")
+}
+
+// move order of path parameter id by advance, respond status name on success
+func (s *ServerHandler) advanceOrder(ctx *gin.Context, advance func(string) error, status string) {
+	id := ctx.Param("id")
+	err := advance(id)
+	if errors.Is(err, repository.ErrOrderNotFound) {
+		ctx.JSON(http.StatusNotFound, &types.Message{
+			Code:    types.CodeFailed,
+			Message: fmt.Sprintf("order [%s] not found", id),
+		})
+		return
+	}
+	var invalid *models.InvalidTransitionError
+	if errors.As(err, &invalid) {
+		ctx.JSON(http.StatusConflict, &types.Message{
+			Code:    types.CodeFailed,
+			Message: fmt.Sprintf("order [%s] error: %v", id, err),
+		})
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, &types.Message{
+			Code:    types.CodeFailed,
+			Message: fmt.Sprintf("set order [%s] %s error: %v", id, status, err),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, &types.Message{
+		Code:    types.CodeSuccess,
+		Message: status,
+	})
+}
+
+// @description http handler that user can call it to list orders,
+// filtered by order_type, order_status (name of models.OrderStatus) and
+// created time in [from, to) (RFC3339). Orders are ordered by OrderId,
+// pass nextCursor of the response as cursor to get next page.
+// example: GET http://127.0.0.1:8080/api/orders?order_type=fifo&order_status=finished&limit=20
+// @param ctx *gin.Context
+// @return
+func (s *ServerHandler) ListOrders(ctx *gin.Context) {
+	filter, err := parseOrderFilter(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, &types.Message{
+			Code:    types.CodeFailed,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	orders, err := s.OrderService.ListOrders(filter)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, &types.Message{
+			Code:    types.CodeFailed,
+			Message: fmt.Sprintf("list orders error: %v", err),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, orders)
+}
+
+func parseOrderFilter(ctx *gin.Context) (*repository.OrderFilter, error) {
+	filter := &repository.OrderFilter{
+		OrderType: ctx.Query("order_type"),
+		Cursor:    ctx.Query("cursor"),
+		Limit:     defaultPageLimit,
+	}
+
+	if status := ctx.Query("order_status"); len(status) > 0 {
+		orderStatus, err := models.ParseOrderStatus(status)
+		if err != nil {
+			return nil, err
+		}
+		filter.OrderStatus = orderStatus
+	}
+
+	var err error
+	if from := ctx.Query("from"); len(from) > 0 {
+		if filter.CreatedFrom, err = time.Parse(time.RFC3339, from); err != nil {
+			return nil, fmt.Errorf("from [%s] is invalid: %v", from, err)
+		}
+	}
+	if to := ctx.Query("to"); len(to) > 0 {
+		if filter.CreatedTo, err = time.Parse(time.RFC3339, to); err != nil {
+			return nil, fmt.Errorf("to [%s] is invalid: %v", to, err)
+		}
+	}
+
+	if limit := ctx.Query("limit"); len(limit) > 0 {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxPageLimit {
+			return nil, fmt.Errorf("limit [%s] is invalid, should be in [1, %d]", limit, maxPageLimit)
+		}
+	}
+	return filter, nil
 }
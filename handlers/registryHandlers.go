@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/averitas/courier_go/types"
+	"github.com/gin-gonic/gin"
+)
+
+// @description http handler that worker call it to register itself
+// as a courier of "match" orders
+// @param ctx *gin.Context
+// @return
+func (s *ServerHandler) RegisterCourier(ctx *gin.Context) {
+	registration, ok := s.bindRegistration(ctx)
+	if !ok {
+		return
+	}
+	s.OrderService.Registry.Register(registration.Url, registration.Capacity)
+	ctx.JSON(http.StatusOK, &types.Message{
+		Code:    types.CodeSuccess,
+		Message: "registered",
+	})
+}
+
+// @description http handler that worker call it periodically to keep alive,
+// return 404 if courier is not registered
+// @param ctx *gin.Context
+// @return
+func (s *ServerHandler) CourierHeartbeat(ctx *gin.Context) {
+	registration, ok := s.bindRegistration(ctx)
+	if !ok {
+		return
+	}
+	if err := s.OrderService.Registry.Heartbeat(registration.Url); err != nil {
+		ctx.JSON(http.StatusNotFound, &types.Message{
+			Code:    types.CodeFailed,
+			Message: fmt.Sprintf("courier [%s] error: %v", registration.Url, err),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, &types.Message{
+		Code:    types.CodeSuccess,
+		Message: "alive",
+	})
+}
+
+// @description http handler that worker call it when shutting down
+// @param ctx *gin.Context
+// @return
+func (s *ServerHandler) DeregisterCourier(ctx *gin.Context) {
+	registration, ok := s.bindRegistration(ctx)
+	if !ok {
+		return
+	}
+	s.OrderService.Registry.Deregister(registration.Url)
+	ctx.JSON(http.StatusOK, &types.Message{
+		Code:    types.CodeSuccess,
+		Message: "deregistered",
+	})
+}
+
+// @description http handler that list all couriers known by apiserver
+// example: GET http://127.0.0.1:8080/api/couriers
+// @param ctx *gin.Context
+// @return
+func (s *ServerHandler) ListCouriers(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, s.OrderService.Registry.Couriers())
+}
+
+func (s *ServerHandler) bindRegistration(ctx *gin.Context) (*types.CourierRegistration, bool) {
+	registration := &types.CourierRegistration{}
+	if err := ctx.BindJSON(registration); err != nil {
+		ctx.JSON(http.StatusBadRequest, &types.Message{
+			Code:    types.CodeFailed,
+			Message: fmt.Sprintf("input json format err: %v", err),
+		})
+		return nil, false
+	}
+	if s.OrderService.Registry == nil {
+		ctx.JSON(http.StatusInternalServerError, &types.Message{
+			Code:    types.CodeFailed,
+			Message: "courier registry is not enabled",
+		})
+		return nil, false
+	}
+	return registration, true
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/averitas/courier_go/db"
+	"github.com/averitas/courier_go/migrations"
+	"github.com/averitas/courier_go/tools/logger"
+)
+
+// apply, revert and list schema migrations
+// usage: migrate [-dsn dsn] up|down|status
+func main() {
+	dsn := flag.String(
+		"dsn",
+		"user:my-secret-pw@tcp(127.0.0.1:3306)/test?charset=utf8mb4&parseTime=True&loc=Local",
+		"database connect string: mysql dsn, postgres://... or sqlite://{file}")
+	connectTimeout := flag.Duration("connectTimeout", 0, "keep retrying to connect database in this duration, e.g. database is still booting")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] up|down|status\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	gormDb, err := db.InitDb(*dsn, &db.Options{ConnectTimeout: *connectTimeout})
+	if err != nil {
+		logger.ErrorLogger.Fatalf("%v\n", err)
+	}
+
+	switch flag.Arg(0) {
+	case "up":
+		applied, err := migrations.Up(gormDb)
+		for _, migration := range applied {
+			fmt.Printf("applied %d %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			logger.ErrorLogger.Fatalf("migrate up error: %v\n", err)
+		}
+		fmt.Printf("schema is at version %d\n", migrations.LatestVersion())
+	case "down":
+		reverted, err := migrations.Down(gormDb)
+		if err != nil {
+			logger.ErrorLogger.Fatalf("migrate down error: %v\n", err)
+		}
+		if reverted == nil {
+			fmt.Println("no migration applied")
+			return
+		}
+		fmt.Printf("reverted %d %s\n", reverted.Version, reverted.Name)
+	case "status":
+		status, err := migrations.Status(gormDb)
+		if err != nil {
+			logger.ErrorLogger.Fatalf("migrate status error: %v\n", err)
+		}
+		for _, s := range status {
+			appliedAt := "pending"
+			if s.Applied {
+				appliedAt = s.AppliedAt.Format("2006-01-02T15:04:05Z07:00")
+			}
+			fmt.Printf("%04d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
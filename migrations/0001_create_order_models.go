@@ -0,0 +1,34 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type orderModelV1 struct {
+	OrderId     string `gorm:"primaryKey;size:32"`
+	OrderType   string `gorm:"size:32"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeletedAt   gorm.DeletedAt
+	Id          string `gorm:"uniqueIndex;size:191"`
+	Name        string
+	PrepTime    int
+	OrderStatus int
+}
+
+func (orderModelV1) TableName() string {
+	return "order_models"
+}
+
+var createOrderModels = &Migration{
+	Version: 1,
+	Name:    "create_order_models",
+	Up: func(tx *gorm.DB) error {
+		return createTable(tx, &orderModelV1{})
+	},
+	Down: func(tx *gorm.DB) error {
+		return tx.Migrator().DropTable(&orderModelV1{})
+	},
+}
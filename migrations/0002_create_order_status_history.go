@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type orderStatusHistoryV2 struct {
+	ID         uint64 `gorm:"primaryKey;autoIncrement"`
+	OrderId    string `gorm:"index;size:32"`
+	FromStatus int
+	ToStatus   int
+	Actor      string `gorm:"size:64"`
+	CreatedAt  time.Time
+}
+
+func (orderStatusHistoryV2) TableName() string {
+	return "order_status_history"
+}
+
+var createOrderStatusHistory = &Migration{
+	Version: 2,
+	Name:    "create_order_status_history",
+	Up: func(tx *gorm.DB) error {
+		return createTable(tx, &orderStatusHistoryV2{})
+	},
+	Down: func(tx *gorm.DB) error {
+		return tx.Migrator().DropTable(&orderStatusHistoryV2{})
+	},
+}
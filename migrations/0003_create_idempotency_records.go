@@ -0,0 +1,31 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type idempotencyRecordV3 struct {
+	Key         string `gorm:"primaryKey;size:191"`
+	RequestHash string `gorm:"size:64"`
+	StatusCode  int
+	Response    string `gorm:"type:text"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (idempotencyRecordV3) TableName() string {
+	return "idempotency_records"
+}
+
+var createIdempotencyRecords = &Migration{
+	Version: 3,
+	Name:    "create_idempotency_records",
+	Up: func(tx *gorm.DB) error {
+		return createTable(tx, &idempotencyRecordV3{})
+	},
+	Down: func(tx *gorm.DB) error {
+		return tx.Migrator().DropTable(&idempotencyRecordV3{})
+	},
+}
@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type outboxMessageV4 struct {
+	ID            uint64    `gorm:"primaryKey;autoIncrement"`
+	OrderId       string    `gorm:"uniqueIndex;size:32"`
+	Kind          string    `gorm:"size:32"`
+	Payload       string    `gorm:"type:text"`
+	Status        int       `gorm:"index:idx_outbox_pending,priority:1"`
+	NextAttemptAt time.Time `gorm:"index:idx_outbox_pending,priority:2"`
+	Attempts      int
+	LastError     string `gorm:"type:text"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+func (outboxMessageV4) TableName() string {
+	return "outbox"
+}
+
+var createOutbox = &Migration{
+	Version: 4,
+	Name:    "create_outbox",
+	Up: func(tx *gorm.DB) error {
+		return createTable(tx, &outboxMessageV4{})
+	},
+	Down: func(tx *gorm.DB) error {
+		return tx.Migrator().DropTable(&outboxMessageV4{})
+	},
+}
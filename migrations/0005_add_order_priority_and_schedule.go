@@ -0,0 +1,27 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type orderModelV5 struct {
+	Priority    int
+	ScheduledAt *time.Time
+}
+
+func (orderModelV5) TableName() string {
+	return "order_models"
+}
+
+var addOrderPriorityAndSchedule = &Migration{
+	Version: 5,
+	Name:    "add_order_priority_and_schedule",
+	Up: func(tx *gorm.DB) error {
+		return addColumns(tx, &orderModelV5{}, "Priority", "ScheduledAt")
+	},
+	Down: func(tx *gorm.DB) error {
+		return dropColumns(tx, &orderModelV5{}, "Priority", "ScheduledAt")
+	},
+}
@@ -0,0 +1,53 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type orderModelV6 struct {
+	CookingOwner    string `gorm:"index;size:191"`
+	CookingDeadline *time.Time
+}
+
+func (orderModelV6) TableName() string {
+	return "order_models"
+}
+
+type workerHeartbeatV6 struct {
+	Owner       string    `gorm:"primaryKey;size:191"`
+	HeartbeatAt time.Time `gorm:"index"`
+}
+
+func (workerHeartbeatV6) TableName() string {
+	return "worker_heartbeats"
+}
+
+var addCookingOwner = &Migration{
+	Version: 6,
+	Name:    "add_cooking_owner",
+	Up: func(tx *gorm.DB) error {
+		err := addColumns(tx, &orderModelV6{}, "CookingOwner", "CookingDeadline")
+		if err != nil {
+			return err
+		}
+		if !tx.Migrator().HasIndex(&orderModelV6{}, "CookingOwner") {
+			if err := tx.Migrator().CreateIndex(&orderModelV6{}, "CookingOwner"); err != nil {
+				return err
+			}
+		}
+		return createTable(tx, &workerHeartbeatV6{})
+	},
+	Down: func(tx *gorm.DB) error {
+		if err := tx.Migrator().DropTable(&workerHeartbeatV6{}); err != nil {
+			return err
+		}
+		if tx.Migrator().HasIndex(&orderModelV6{}, "CookingOwner") {
+			if err := tx.Migrator().DropIndex(&orderModelV6{}, "CookingOwner"); err != nil {
+				return err
+			}
+		}
+		return dropColumns(tx, &orderModelV6{}, "CookingOwner", "CookingDeadline")
+	},
+}
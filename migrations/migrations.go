@@ -0,0 +1,215 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration change schema from Version-1 to Version, Down reverts it.
+// Every migration is in its own file named {Version}_{Name}.go and declares
+// tables as they are in that version, so it doesn't change with models.
+// Up must succeed on databases whose tables were created by hand before
+// migrations existed, so it skips tables and columns already there.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// all migrations ordered by version, append new migrations here
+var migrations = []*Migration{
+	createOrderModels,
+	createOrderStatusHistory,
+	createIdempotencyRecords,
+	createOutbox,
+	addOrderPriorityAndSchedule,
+	addCookingOwner,
+}
+
+// applied migration recorded in schema_migrations
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// status of a migration
+type MigrationStatus struct {
+	*Migration
+	Applied bool
+	// zero if not applied
+	AppliedAt time.Time
+}
+
+// ErrVersionMismatch is returned by CheckVersion if schema isn't at LatestVersion
+var ErrVersionMismatch = errors.New("schema version mismatch")
+
+// @description version of schema expected by this build
+// @return int
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// @description version of latest migration applied to database, 0 if none
+// @param db *gorm.DB
+// @return int
+// @return error
+func CurrentVersion(db *gorm.DB) (int, error) {
+	if !db.Migrator().HasTable(&SchemaMigration{}) {
+		return 0, nil
+	}
+	var version int
+	err := db.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	if err != nil {
+		return 0, fmt.Errorf("query schema version error: %v", err)
+	}
+	return version, nil
+}
+
+// @description check schema of database is at LatestVersion, servers refuse to start otherwise
+// @param db *gorm.DB
+// @return error wraps ErrVersionMismatch if version is different
+func CheckVersion(db *gorm.DB) error {
+	version, err := CurrentVersion(db)
+	if err != nil {
+		return err
+	}
+	if version != LatestVersion() {
+		return fmt.Errorf("%w: database is at version %d, expected %d, please run migrate up",
+			ErrVersionMismatch, version, LatestVersion())
+	}
+	return nil
+}
+
+// @description apply migrations not applied yet in order, each in a transaction
+// @param db *gorm.DB
+// @return []*Migration applied migrations
+// @return error
+func Up(db *gorm.DB) ([]*Migration, error) {
+	if err := db.Migrator().AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, fmt.Errorf("create schema_migrations error: %v", err)
+	}
+	version, err := CurrentVersion(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []*Migration
+	for _, migration := range migrations {
+		if migration.Version <= version {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return applied, fmt.Errorf("apply migration %d %s error: %v", migration.Version, migration.Name, err)
+		}
+		applied = append(applied, migration)
+	}
+	return applied, nil
+}
+
+// @description revert latest applied migration in a transaction
+// @param db *gorm.DB
+// @return *Migration reverted migration, nil if no migration applied
+// @return error
+func Down(db *gorm.DB) (*Migration, error) {
+	version, err := CurrentVersion(db)
+	if err != nil || version == 0 {
+		return nil, err
+	}
+	migration := find(version)
+	if migration == nil {
+		return nil, fmt.Errorf("migration %d is unknown, database is newer than this build", version)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := migration.Down(tx); err != nil {
+			return err
+		}
+		return tx.Delete(&SchemaMigration{}, migration.Version).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("revert migration %d %s error: %v", migration.Version, migration.Name, err)
+	}
+	return migration, nil
+}
+
+// @description list all migrations and whether they are applied
+// @param db *gorm.DB
+// @return []*MigrationStatus ordered by version
+// @return error
+func Status(db *gorm.DB) ([]*MigrationStatus, error) {
+	var records []*SchemaMigration
+	if db.Migrator().HasTable(&SchemaMigration{}) {
+		if err := db.Find(&records).Error; err != nil {
+			return nil, fmt.Errorf("list schema migrations error: %v", err)
+		}
+	}
+	appliedAt := make(map[int]time.Time, len(records))
+	for _, record := range records {
+		appliedAt[record.Version] = record.AppliedAt
+	}
+
+	res := make([]*MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		at, ok := appliedAt[migration.Version]
+		res = append(res, &MigrationStatus{Migration: migration, Applied: ok, AppliedAt: at})
+	}
+	return res, nil
+}
+
+func find(version int) *Migration {
+	for _, migration := range migrations {
+		if migration.Version == version {
+			return migration
+		}
+	}
+	return nil
+}
+
+// create table of model if it doesn't exist
+func createTable(tx *gorm.DB, model interface{}) error {
+	if tx.Migrator().HasTable(model) {
+		return nil
+	}
+	return tx.Migrator().CreateTable(model)
+}
+
+// add columns of fields to table of model if they don't exist
+func addColumns(tx *gorm.DB, model interface{}, fields ...string) error {
+	for _, field := range fields {
+		if tx.Migrator().HasColumn(model, field) {
+			continue
+		}
+		if err := tx.Migrator().AddColumn(model, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drop columns of fields from table of model if they exist
+func dropColumns(tx *gorm.DB, model interface{}, fields ...string) error {
+	for _, field := range fields {
+		if !tx.Migrator().HasColumn(model, field) {
+			continue
+		}
+		if err := tx.Migrator().DropColumn(model, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
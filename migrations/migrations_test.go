@@ -0,0 +1,83 @@
+package migrations
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/averitas/courier_go/db"
+	"github.com/averitas/courier_go/models"
+	"gorm.io/gorm"
+)
+
+func TestMigrations(t *testing.T) {
+	gdb, err := gorm.Open(db.Open("sqlite://file:migrations?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckVersion(gdb); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("expected version mismatch of empty database, got %v", err)
+	}
+	applied, err := Up(gdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("expected %d migrations applied, got %d", len(migrations), len(applied))
+	}
+	if err := CheckVersion(gdb); err != nil {
+		t.Fatal(err)
+	}
+
+	// migrations are in sync with models
+	for _, model := range []interface{}{
+		&models.OrderModel{}, &models.OrderStatusHistory{}, &models.IdempotencyRecord{},
+		&models.OutboxMessage{}, &models.WorkerHeartbeat{},
+	} {
+		stmt := &gorm.Statement{DB: gdb}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if !gdb.Migrator().HasColumn(model, field.DBName) {
+				t.Errorf("column %s of table %s is not created by migrations", field.DBName, stmt.Schema.Table)
+			}
+		}
+		for _, index := range stmt.Schema.ParseIndexes() {
+			if !gdb.Migrator().HasIndex(model, index.Name) {
+				t.Errorf("index %s of table %s is not created by migrations", index.Name, stmt.Schema.Table)
+			}
+		}
+	}
+
+	// revert latest migration, then apply it again
+	reverted, err := Down(gdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted.Version != LatestVersion() {
+		t.Errorf("expected migration %d reverted, got %d", LatestVersion(), reverted.Version)
+	}
+	status, err := Status(gdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if s.Applied != (s.Version < LatestVersion()) {
+			t.Errorf("migration %d applied is %v", s.Version, s.Applied)
+		}
+	}
+	if applied, err = Up(gdb); err != nil || len(applied) != 1 {
+		t.Errorf("expected latest migration applied again, got %v %v", applied, err)
+	}
+
+	// revert all migrations
+	for version := LatestVersion(); version > 0; version-- {
+		if _, err := Down(gdb); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if version, err := CurrentVersion(gdb); err != nil || version != 0 || gdb.Migrator().HasTable("order_models") {
+		t.Errorf("expected all migrations reverted, got version %d %v", version, err)
+	}
+}
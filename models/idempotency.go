@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// response of a request sent with Idempotency-Key header,
+// it's replayed when client retries the request with same key
+type IdempotencyRecord struct {
+	Key string `gorm:"primaryKey;size:191"`
+	// sha256 of request method, path and body
+	RequestHash string `gorm:"size:64"`
+	// 0 if request is still processing
+	StatusCode int
+	Response   string `gorm:"type:text"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
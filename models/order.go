@@ -1,57 +1,48 @@
 package models
 
 import (
-	"errors"
-	"fmt"
-	"strconv"
 	"time"
 
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 )
 
-type OrderStatus int
-
 const (
-	OrderStarted  OrderStatus = 1
-	OrderCooking  OrderStatus = 2
-	OrderFinished OrderStatus = 3
-
 	OrderIdPrefix string = "ORDER"
 )
 
 // Order model
 type OrderModel struct {
-	OrderId     string    `gorm:"primaryKey size:32"`
-	OrderType   string    `gorm:"size:32"`
-	CreatedAt   time.Time `gorm:"autoCreateTime:milli"`
-	UpdatedAt   time.Time `gorm:"autoUpdateTime:milli"`
-	DeletedAt   gorm.DeletedAt
-	Id          string `gorm:"uniqueIndex size:191"`
-	Name        string
-	PrepTime    int
+	OrderId   string    `gorm:"primaryKey;size:32"`
+	OrderType string    `gorm:"size:32"`
+	CreatedAt time.Time `gorm:"autoCreateTime:milli"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime:milli"`
+	DeletedAt gorm.DeletedAt
+	Id        string `gorm:"uniqueIndex;size:191"`
+	Name      string
+	PrepTime  int
+	Priority  int
+	// time scheduled order should be cooked, nil if order is cooked at once
+	ScheduledAt *time.Time
 	OrderStatus OrderStatus
+	// worker cooking the order and when it's cooked, set when cooking started
+	CookingOwner    string `gorm:"index;size:191"`
+	CookingDeadline *time.Time
 }
 
-// because current server is singleton,
-// so we use db to create an unique primary key
-// please use transaction to execute this function
-// id format: {OrderIdPrefix}000000001
-func (model *OrderModel) GenerateUniqueKey(db *gorm.DB) (string, error) {
-	var latestModel OrderModel
-	result := db.Set("gorm:query_option", "FOR UPDATE").
-		Order(clause.OrderByColumn{Column: clause.Column{Name: "order_id"}, Desc: true}).
-		Last(&latestModel)
-	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		return fmt.Sprintf("%s%09d", OrderIdPrefix, 1), nil
-	} else if result.Error != nil {
-		return "", fmt.Errorf("access db error %v", result.Error)
-	}
-	surfix := latestModel.OrderId[len(OrderIdPrefix):]
-	index, err := strconv.Atoi(surfix)
-	if err != nil {
-		return "", fmt.Errorf("db dirty data: %s %v", latestModel.OrderId, err)
+// pickup delay of order finished at finishedAt: time from created to finished minus prep time,
+// or time from scheduled to finished for scheduled order.
+// UpdatedAt isn't used since it moves on with later transitions, e.g. picked up or delivered
+func (model *OrderModel) PickupDelay(finishedAt time.Time) time.Duration {
+	if model.ScheduledAt != nil {
+		return finishedAt.Sub(*model.ScheduledAt)
 	}
+	return finishedAt.Sub(model.CreatedAt) - time.Duration(model.PrepTime)*time.Second
+}
 
-	return fmt.Sprintf("%s%09d", OrderIdPrefix, index+1), nil
+// time to dispatch scheduled order so it's cooked at ScheduledAt, zero if not scheduled
+func (model *OrderModel) DispatchAt() time.Time {
+	if model.ScheduledAt == nil {
+		return time.Time{}
+	}
+	return model.ScheduledAt.Add(-time.Duration(model.PrepTime) * time.Second)
 }
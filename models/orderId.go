@@ -0,0 +1,88 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// IdGenerator generate OrderId of new orders, ids must be unique
+// across all apiservers and increase with time
+type IdGenerator interface {
+	NextId() (string, error)
+}
+
+const (
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+
+	// max node id of SnowflakeGenerator
+	MaxNodeId = 1<<snowflakeNodeBits - 1
+
+	maxSequence = 1<<snowflakeSequenceBits - 1
+	// clock moved backwards more than this is an error, otherwise generator waits for it
+	maxClockBackwards = time.Second
+)
+
+// epoch of snowflake ids, 2022-01-01T00:00:00Z
+var snowflakeEpoch = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// SnowflakeGenerator generate ids of 41 bits milliseconds since epoch, 10 bits node id
+// and 12 bits sequence, so apiservers with different node id never generate same id.
+// id format: {OrderIdPrefix}{19 digits}, ids are sorted by time as strings, and after
+// ids of old format {OrderIdPrefix}000000001.
+type SnowflakeGenerator struct {
+	mu       sync.Mutex
+	node     int64
+	last     int64
+	sequence int64
+
+	// used to mock time in tests
+	now func() time.Time
+}
+
+// @description create snowflake id generator
+// @param node int64 unique id of apiserver in [0, MaxNodeId]
+// @return *SnowflakeGenerator
+// @return error
+func NewSnowflakeGenerator(node int64) (*SnowflakeGenerator, error) {
+	if node < 0 || node > MaxNodeId {
+		return nil, fmt.Errorf("node id %d is out of range [0, %d]", node, MaxNodeId)
+	}
+	return &SnowflakeGenerator{node: node, now: time.Now}, nil
+}
+
+func (g *SnowflakeGenerator) NextId() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	millis := g.millis()
+	if millis < g.last {
+		if time.Duration(g.last-millis)*time.Millisecond > maxClockBackwards {
+			return "", fmt.Errorf("clock moved backwards %dms", g.last-millis)
+		}
+		for millis < g.last {
+			time.Sleep(time.Millisecond)
+			millis = g.millis()
+		}
+	}
+
+	if millis == g.last {
+		g.sequence = (g.sequence + 1) & maxSequence
+		// sequence of this millisecond is used up, wait for next one
+		for g.sequence == 0 && millis <= g.last {
+			time.Sleep(100 * time.Microsecond)
+			millis = g.millis()
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.last = millis
+
+	id := millis<<(snowflakeNodeBits+snowflakeSequenceBits) | g.node<<snowflakeSequenceBits | g.sequence
+	return fmt.Sprintf("%s%019d", OrderIdPrefix, id), nil
+}
+
+func (g *SnowflakeGenerator) millis() int64 {
+	return g.now().Sub(snowflakeEpoch).Milliseconds()
+}
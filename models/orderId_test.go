@@ -0,0 +1,45 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnowflakeGenerator(t *testing.T) {
+	if _, err := NewSnowflakeGenerator(MaxNodeId + 1); err == nil {
+		t.Errorf("expected error of invalid node id")
+	}
+
+	now := time.Date(2022, 11, 20, 0, 0, 0, 0, time.UTC)
+	node1, _ := NewSnowflakeGenerator(1)
+	node2, _ := NewSnowflakeGenerator(2)
+	node1.now = func() time.Time { return now }
+	node2.now = func() time.Time { return now }
+
+	// ids of same millisecond are unique across nodes and sorted in each node
+	seen := make(map[string]bool)
+	last := "ORDER000000001"
+	for i := 0; i < 100; i++ {
+		for _, g := range []*SnowflakeGenerator{node1, node2} {
+			id, err := g.NextId()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(id) != len(OrderIdPrefix)+19 || seen[id] {
+				t.Fatalf("id %s is invalid or duplicated", id)
+			}
+			seen[id] = true
+		}
+		id, _ := node1.NextId()
+		if id <= last {
+			t.Fatalf("id %s is not after %s", id, last)
+		}
+		last = id
+	}
+
+	// clock moved backwards too much
+	now = now.Add(-2 * time.Second)
+	if _, err := node1.NextId(); err == nil {
+		t.Errorf("expected error of clock moved backwards")
+	}
+}
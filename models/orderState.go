@@ -0,0 +1,131 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+type OrderStatus int
+
+const (
+	OrderStarted        OrderStatus = 1
+	OrderCooking        OrderStatus = 2
+	OrderFinished       OrderStatus = 3
+	OrderCancelled      OrderStatus = 4
+	OrderDispatched     OrderStatus = 5
+	OrderCourierArrived OrderStatus = 6
+	OrderPickedUp       OrderStatus = 7
+	OrderDelivered      OrderStatus = 8
+	OrderFailed         OrderStatus = 9
+)
+
+var orderStatusNames = map[OrderStatus]string{
+	OrderStarted:        "started",
+	OrderCooking:        "cooking",
+	OrderFinished:       "finished",
+	OrderCancelled:      "cancelled",
+	OrderDispatched:     "dispatched",
+	OrderCourierArrived: "courier_arrived",
+	OrderPickedUp:       "picked_up",
+	OrderDelivered:      "delivered",
+	OrderFailed:         "failed",
+}
+
+// actor of transitions made by apiserver
+const ActorApiServer = "apiserver"
+
+// legal transitions of order status:
+//
+//	started -> dispatched -> courier_arrived -> cooking -> finished -> picked_up -> delivered
+//
+// orders could be cancelled or failed before finished, picked up orders could fail
+// on the way. delivered, cancelled and failed are terminal status, except that
+// failed -> dispatched retries orders failed to dispatch when they're submitted again.
+// started -> cooking is kept for orders created before dispatched status existed.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderStarted:        {OrderDispatched, OrderCooking, OrderCancelled, OrderFailed},
+	OrderDispatched:     {OrderCourierArrived, OrderCooking, OrderCancelled, OrderFailed},
+	OrderCourierArrived: {OrderCooking, OrderCancelled, OrderFailed},
+	OrderCooking:        {OrderFinished, OrderCancelled, OrderFailed},
+	OrderFinished:       {OrderPickedUp},
+	OrderPickedUp:       {OrderDelivered, OrderFailed},
+	OrderFailed:         {OrderDispatched},
+}
+
+var terminalStatuses = map[OrderStatus]bool{
+	OrderDelivered: true,
+	OrderCancelled: true,
+	OrderFailed:    true,
+}
+
+func (s OrderStatus) String() string {
+	if name, ok := orderStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// order in terminal status isn't handled any more
+func (s OrderStatus) IsTerminal() bool {
+	return terminalStatuses[s]
+}
+
+// parse status name returned by OrderStatus.String
+func ParseOrderStatus(name string) (OrderStatus, error) {
+	for status, statusName := range orderStatusNames {
+		if statusName == name {
+			return status, nil
+		}
+	}
+	return 0, fmt.Errorf("order status [%s] is invalid", name)
+}
+
+// returned when order status can't move from From to To
+type InvalidTransitionError struct {
+	OrderId string
+	From    OrderStatus
+	To      OrderStatus
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("order [%s] can't move from %v to %v", e.OrderId, e.From, e.To)
+}
+
+// CanTransition return true if status could move from -> to
+func CanTransition(from, to OrderStatus) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition validate and move model to status to,
+// return *InvalidTransitionError if it's illegal
+func (model *OrderModel) Transition(to OrderStatus) error {
+	if !CanTransition(model.OrderStatus, to) {
+		return &InvalidTransitionError{
+			OrderId: model.OrderId,
+			From:    model.OrderStatus,
+			To:      to,
+		}
+	}
+	model.OrderStatus = to
+	return nil
+}
+
+// a row of order_status_history, written for every status transition
+type OrderStatusHistory struct {
+	ID         uint64 `gorm:"primaryKey;autoIncrement"`
+	OrderId    string `gorm:"index;size:32"`
+	FromStatus OrderStatus
+	ToStatus   OrderStatus
+	// who made the transition, e.g. apiserver or worker address
+	Actor     string    `gorm:"size:64"`
+	CreatedAt time.Time `gorm:"autoCreateTime:milli"`
+}
+
+func (OrderStatusHistory) TableName() string {
+	return "order_status_history"
+}
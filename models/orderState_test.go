@@ -0,0 +1,45 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOrderTransition(t *testing.T) {
+	model := &OrderModel{OrderId: "ORDER000000001", OrderStatus: OrderStarted}
+	for _, to := range []OrderStatus{OrderDispatched, OrderCourierArrived, OrderCooking, OrderFinished, OrderPickedUp, OrderDelivered} {
+		if err := model.Transition(to); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := model.Transition(OrderCancelled)
+	var invalid *InvalidTransitionError
+	if !errors.As(err, &invalid) || invalid.From != OrderDelivered || invalid.To != OrderCancelled {
+		t.Errorf("expected invalid transition error, got %v", err)
+	}
+	if model.OrderStatus != OrderDelivered {
+		t.Errorf("status changed by illegal transition: %v", model.OrderStatus)
+	}
+
+	// failed order could only be dispatched again
+	model.OrderStatus = OrderFailed
+	if !model.OrderStatus.IsTerminal() || model.Transition(OrderCooking) == nil {
+		t.Errorf("failed order should be terminal and can't be cooked")
+	}
+	if err := model.Transition(OrderDispatched); err != nil {
+		t.Errorf("failed order should be dispatched again, got %v", err)
+	}
+}
+
+func TestParseOrderStatus(t *testing.T) {
+	for status := range orderStatusNames {
+		parsed, err := ParseOrderStatus(status.String())
+		if err != nil || parsed != status {
+			t.Errorf("parse %v got %v, %v", status, parsed, err)
+		}
+	}
+	if _, err := ParseOrderStatus("unknown"); err == nil {
+		t.Errorf("expected error of unknown status")
+	}
+}
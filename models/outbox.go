@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+type OutboxStatus int
+
+const (
+	// waiting to be published by request or relay
+	OutboxPending OutboxStatus = 0
+	// order is sent to queue or courier
+	OutboxDelivered OutboxStatus = 1
+	// order couldn't be sent and is failed, it won't be published
+	OutboxDiscarded OutboxStatus = 2
+)
+
+// OutboxMessage is written in the same transaction of its order, so an order
+// saved is always dispatched: by the request saving it, or by relay later
+type OutboxMessage struct {
+	ID      uint64 `gorm:"primaryKey;autoIncrement"`
+	OrderId string `gorm:"uniqueIndex;size:32"`
+	// order type, decide where the message is published
+	Kind string `gorm:"size:32"`
+	// json of types.Order
+	Payload string       `gorm:"type:text"`
+	Status  OutboxStatus `gorm:"index:idx_outbox_pending,priority:1"`
+	// relay doesn't publish message before this time
+	NextAttemptAt time.Time `gorm:"index:idx_outbox_pending,priority:2"`
+	// publish attempts of relay
+	Attempts  int
+	LastError string `gorm:"type:text"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (OutboxMessage) TableName() string {
+	return "outbox"
+}
@@ -0,0 +1,10 @@
+package models
+
+import "time"
+
+// last heartbeat of worker cooking orders, orders of worker stopped heartbeating
+// are taken over by other workers
+type WorkerHeartbeat struct {
+	Owner       string    `gorm:"primaryKey;size:191"`
+	HeartbeatAt time.Time `gorm:"index"`
+}
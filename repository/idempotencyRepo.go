@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/averitas/courier_go/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// returned by CreateRecord if record with same key exists
+var ErrIdempotencyKeyExists = fmt.Errorf("idempotency key already exists")
+
+type IIdempotencyRepo interface {
+	// Create record, return ErrIdempotencyKeyExists if @field Key exists
+	CreateRecord(*models.IdempotencyRecord) error
+	// Get record by @field Key, return ErrOrderNotFound if not exists
+	GetRecord(string) (*models.IdempotencyRecord, error)
+	// Update status code and response of record by @field Key
+	UpdateRecord(*models.IdempotencyRecord) error
+	// Delete record by @field Key
+	DeleteRecord(string) error
+	// Delete records created before time
+	DeleteRecordsBefore(time.Time) error
+}
+
+type IdempotencyRepo struct {
+	db *gorm.DB
+}
+
+// @description create idempotency repository on database
+// @param gormDb *gorm.DB
+// @return *IdempotencyRepo
+func NewIdempotencyRepo(gormDb *gorm.DB) *IdempotencyRepo {
+	return &IdempotencyRepo{db: gormDb}
+}
+
+func (r *IdempotencyRepo) CreateRecord(record *models.IdempotencyRecord) error {
+	result := r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrIdempotencyKeyExists
+	}
+	return nil
+}
+
+func (r *IdempotencyRepo) GetRecord(key string) (res *models.IdempotencyRecord, err error) {
+	// struct condition let gorm quote column "key" which is reserved in some databases
+	err = r.db.Where(&models.IdempotencyRecord{Key: key}).First(&res).Error
+	return
+}
+
+func (r *IdempotencyRepo) UpdateRecord(record *models.IdempotencyRecord) error {
+	return r.db.Model(record).Updates(record).Error
+}
+
+func (r *IdempotencyRepo) DeleteRecord(key string) error {
+	return r.db.Delete(&models.IdempotencyRecord{Key: key}).Error
+}
+
+func (r *IdempotencyRepo) DeleteRecordsBefore(t time.Time) error {
+	return r.db.Where("created_at < ?", t).Delete(&models.IdempotencyRecord{}).Error
+}
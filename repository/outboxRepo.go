@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/averitas/courier_go/models"
+	"gorm.io/gorm"
+)
+
+type IOutboxRepo interface {
+	// List pending messages to publish before time ordered by @field OutboxMessage.ID
+	ListPendingOutbox(time.Time, int) ([]*models.OutboxMessage, error)
+	// Claim message by increasing its attempts and delaying next attempt to time,
+	// return false if others claimed it or it's not pending any more
+	ClaimOutbox(*models.OutboxMessage, time.Time) (bool, error)
+	// Save attempts, error and next attempt of message
+	UpdateOutbox(*models.OutboxMessage) error
+	// Close message of order by @field OutboxMessage.OrderId with status
+	CloseOutbox(string, models.OutboxStatus) error
+	// Make closed message of order by @field OutboxMessage.OrderId pending again
+	// with no attempts, its next attempt is at time
+	ReopenOutbox(string, time.Time) error
+}
+
+type OutboxRepo struct {
+	db *gorm.DB
+}
+
+// @description create outbox repository on database
+// @param gormDb *gorm.DB
+// @return *OutboxRepo
+func NewOutboxRepo(gormDb *gorm.DB) *OutboxRepo {
+	return &OutboxRepo{db: gormDb}
+}
+
+func (r *OutboxRepo) ListPendingOutbox(before time.Time, limit int) (res []*models.OutboxMessage, err error) {
+	err = r.db.Where("status = ? AND next_attempt_at <= ?", models.OutboxPending, before).
+		Order("id").Limit(limit).Find(&res).Error
+	return
+}
+
+func (r *OutboxRepo) ClaimOutbox(msg *models.OutboxMessage, until time.Time) (bool, error) {
+	// attempts is the version of message, only one relay could increase it
+	result := r.db.Model(&models.OutboxMessage{}).
+		Where("id = ? AND status = ? AND attempts = ?", msg.ID, models.OutboxPending, msg.Attempts).
+		Updates(map[string]interface{}{"attempts": msg.Attempts + 1, "next_attempt_at": until})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	msg.Attempts++
+	msg.NextAttemptAt = until
+	return true, nil
+}
+
+func (r *OutboxRepo) UpdateOutbox(msg *models.OutboxMessage) error {
+	return r.db.Model(msg).Select("status", "next_attempt_at", "last_error").Updates(msg).Error
+}
+
+func (r *OutboxRepo) CloseOutbox(orderId string, status models.OutboxStatus) error {
+	return r.db.Model(&models.OutboxMessage{}).
+		Where("order_id = ? AND status = ?", orderId, models.OutboxPending).
+		Update("status", status).Error
+}
+
+func (r *OutboxRepo) ReopenOutbox(orderId string, nextAttemptAt time.Time) error {
+	return r.db.Model(&models.OutboxMessage{}).
+		Where("order_id = ? AND status <> ?", orderId, models.OutboxPending).
+		Updates(map[string]interface{}{
+			"status":          models.OutboxPending,
+			"attempts":        0,
+			"next_attempt_at": nextAttemptAt,
+			"last_error":      "",
+		}).Error
+}
@@ -2,58 +2,518 @@ package repository
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/averitas/courier_go/db"
 	"github.com/averitas/courier_go/models"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// returned by GetOrderById if order doesn't exist
+var ErrOrderNotFound = gorm.ErrRecordNotFound
+
+// returned by CreateOrder if order with same client supplied id exists
+var ErrOrderExists = fmt.Errorf("order with same id already exists")
+
+// returned by CreateOrder if generated OrderId is used by another order,
+// e.g. id generators of several apiservers have the same node id
+var ErrOrderIdConflict = fmt.Errorf("generated order id is used by another order")
+
 type IOrderRepo interface {
-	CreateOrder(*models.OrderModel) error
+	// Create order with new OrderId and its outbox message in one transaction,
+	// return ErrOrderExists if order with same @field OrderModel.Id exists,
+	// ErrOrderIdConflict if generated @field OrderModel.OrderId exists
+	CreateOrder(*models.OrderModel, *models.OutboxMessage) error
 
 	// Upsert order model into database
 	SaveModel(*models.OrderModel) error
 
 	// Get order by @field OrderModel.Id
 	GetOrderById(string) (*models.OrderModel, error)
-	// Calculate average delay of order type filtered by
-	// @field: OrderModel.OrderType
+	// Calculate average pickup delay of orders of order type filtered by
+	// @field: OrderModel.OrderType, only orders have been finished are counted,
+	// delay ends at their transition to finished in @table order_status_history
 	GetAverageDelayOfOrderType(string) (float32, error)
+	// Calculate average pickup delay of finished orders of each @field OrderModel.Priority of order type
+	GetAverageDelayByPriority(string) (map[int]float32, error)
+	// Calculate average seconds orders of order type stayed in each status
+	// before moving on, by @table order_status_history
+	GetAveragePhaseDelay(string) (map[models.OrderStatus]float32, error)
+	// Count pickup delay in milliseconds of orders have been finished in histogram buckets,
+	// optionally grouped by finish time, see DelayFilter
+	GetDelayHistogram(*DelayFilter) ([]*DelayBucketCount, error)
+	// Get exact nearest-rank percentiles of the same delays as GetDelayHistogram in each period,
+	// e.g. percentiles 50, 90 and 99
+	GetDelayPercentiles(*DelayFilter, []int) ([]*DelayPercentile, error)
+	// List orders matching filter ordered by @field OrderModel.OrderId
+	ListOrders(*OrderFilter) ([]*models.OrderModel, error)
+
+	// Move order to status and write status history in one transaction,
+	// return *models.InvalidTransitionError if transition is illegal
+	// or order status was changed by others
+	// @param model *models.OrderModel
+	// @param to models.OrderStatus
+	// @param actor string who make this transition
+	TransitionStatus(*models.OrderModel, models.OrderStatus, string) error
+	// Move order to cooking like TransitionStatus and record worker cooking it
+	// @param model *models.OrderModel
+	// @param owner string worker cooking the order
+	// @param deadline time.Time when order is cooked
+	// @param actor string
+	StartCooking(*models.OrderModel, string, time.Time, string) error
+	// Take over cooking order from @field OrderModel.CookingOwner to owner,
+	// return false if order isn't cooking by previous owner any more
+	ClaimCooking(*models.OrderModel, string) (bool, error)
+	// Get status history of order by @field OrderModel.OrderId ordered by time
+	GetStatusHistory(string) ([]*models.OrderStatusHistory, error)
+}
+
+// filter of ListOrders, zero value fields are ignored
+type OrderFilter struct {
+	OrderType   string
+	OrderStatus models.OrderStatus
+	// worker cooking orders
+	CookingOwner string
+	// created at in [CreatedFrom, CreatedTo)
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// only orders with OrderId greater than Cursor are returned
+	Cursor string
+	Limit  int
+}
+
+// filter of GetDelayHistogram, zero value fields are ignored
+type DelayFilter struct {
+	OrderType string
+	// finished in [FinishedFrom, FinishedTo) by @table order_status_history,
+	// whatever status orders moved on to
+	FinishedFrom time.Time
+	FinishedTo   time.Time
+	// group orders by finish time into periods of this length since unix epoch
+	Period time.Duration
+	// ascending upper bounds of histogram buckets in milliseconds,
+	// delays above the last one are in an extra bucket
+	Bounds []float64
+}
+
+// aggregation of orders in a histogram bucket of a period
+type DelayBucketCount struct {
+	// start of period, zero if not grouped
+	PeriodStart time.Time
+	// index of upper bound in DelayFilter.Bounds, len(Bounds) for the extra bucket
+	Bucket int
+	Count  int
+	// sum and max of delays in milliseconds
+	Sum float64
+	Max float64
+}
+
+// nearest-rank percentile of delays in milliseconds of a period
+type DelayPercentile struct {
+	// start of period, zero if not grouped
+	PeriodStart time.Time
+	Percentile  int
+	Delay       float64
 }
 
 type OrderRepo struct {
+	db *gorm.DB
+	// generate OrderId of created orders, node 0 snowflake generator if not set
+	IdGenerator models.IdGenerator
+}
+
+// @description create order repository on database
+// @param gormDb *gorm.DB
+// @param idGenerator models.IdGenerator generate OrderId, nil for node 0 snowflake generator
+// @return *OrderRepo
+func NewOrderRepo(gormDb *gorm.DB, idGenerator models.IdGenerator) *OrderRepo {
+	return &OrderRepo{db: gormDb, IdGenerator: idGenerator}
+}
+
+var (
+	defaultIdGenerator     models.IdGenerator
+	defaultIdGeneratorOnce sync.Once
+)
+
+func (r *OrderRepo) idGenerator() models.IdGenerator {
+	if r.IdGenerator != nil {
+		return r.IdGenerator
+	}
+	defaultIdGeneratorOnce.Do(func() {
+		defaultIdGenerator, _ = models.NewSnowflakeGenerator(0)
+	})
+	return defaultIdGenerator
 }
 
 func (r *OrderRepo) SaveModel(order *models.OrderModel) error {
-	return db.Db.Save(order).Error
+	return r.db.Save(order).Error
 }
 
 func (r *OrderRepo) GetOrderById(id string) (res *models.OrderModel, err error) {
-	err = db.Db.Where("id = ?", id).Last(&res).Error
+	err = r.db.Where("id = ?", id).Last(&res).Error
 	return
 }
 
+// seconds from column start to column end in sql of dialect
+func secondsBetween(dialect, start, end string) string {
+	switch dialect {
+	case db.DialectPostgres:
+		return fmt.Sprintf("EXTRACT(EPOCH FROM (%s - %s))", end, start)
+	case db.DialectSQLite:
+		return fmt.Sprintf("((julianday(%s) - julianday(%s)) * 86400)", end, start)
+	default:
+		return fmt.Sprintf("(TIMESTAMPDIFF(MICROSECOND, %s, %s) / 1000000)", start, end)
+	}
+}
+
+// pickup delay in seconds of order o until finish time f.created_at of finishedOrders,
+// scheduled order is delayed since scheduled time
+func (r *OrderRepo) pickupDelaySql() string {
+	dialect := r.db.Dialector.Name()
+	return "CASE WHEN o.scheduled_at IS NULL " +
+		"THEN " + secondsBetween(dialect, "o.created_at", "f.created_at") + " - o.prep_time " +
+		"ELSE " + secondsBetween(dialect, "o.scheduled_at", "f.created_at") + " END"
+}
+
+// orders o of order type that have been finished, joined with history f moving them to finished.
+// f.created_at is the finish time, updated_at of order moves on with later transitions
+func (r *OrderRepo) finishedOrders(orderType string) *gorm.DB {
+	return r.db.Table("order_models AS o").
+		Joins("JOIN order_status_history AS f ON f.order_id = o.order_id AND f.to_status = ?", models.OrderFinished).
+		Where("o.order_type = ?", orderType)
+}
+
+// start of period of time column as seconds since unix epoch divided by period
+func periodSql(dialect, column string, seconds int64) string {
+	switch dialect {
+	case db.DialectPostgres:
+		return fmt.Sprintf("CAST(FLOOR(EXTRACT(EPOCH FROM %s) / %d) AS BIGINT)", column, seconds)
+	case db.DialectSQLite:
+		return fmt.Sprintf("(CAST(strftime('%%s', %s) AS INTEGER) / %d)", column, seconds)
+	default:
+		return fmt.Sprintf("FLOOR(UNIX_TIMESTAMP(%s) / %d)", column, seconds)
+	}
+}
+
+// index of the first bound not less than value, len(bounds) if value is above all of them
+func bucketSql(value string, bounds []float64) string {
+	var sb strings.Builder
+	sb.WriteString("CASE")
+	for i, bound := range bounds {
+		fmt.Fprintf(&sb, " WHEN %s <= %s THEN %d", value, strconv.FormatFloat(bound, 'f', -1, 64), i)
+	}
+	fmt.Fprintf(&sb, " ELSE %d END", len(bounds))
+	return sb.String()
+}
+
 func (r *OrderRepo) GetAverageDelayOfOrderType(orderType string) (float32, error) {
-	subQuery := db.Db.Select("DATE_SUB(timediff(updated_at, created_at), INTERVAL prep_time second) AS pickup_delay").
-		Where("order_type = ?", orderType).Table("order_models")
+	subQuery := r.finishedOrders(orderType).Select(r.pickupDelaySql() + " AS pickup_delay")
 	var result float32
-	err := db.Db.Select("AVG(tt.pickup_delay) as avgdelay").Table("(?) as tt", subQuery).Pluck("avgdelay", &result).Error
+	err := r.db.Select("COALESCE(AVG(tt.pickup_delay), 0) as avgdelay").Table("(?) as tt", subQuery).Pluck("avgdelay", &result).Error
 	return result, err
 }
 
-func (r *OrderRepo) CreateOrder(orderModel *models.OrderModel) error {
-	err := db.Db.Transaction(func(tx *gorm.DB) error {
+func (r *OrderRepo) GetAverageDelayByPriority(orderType string) (map[int]float32, error) {
+	subQuery := r.finishedOrders(orderType).Select("o.priority AS priority, " + r.pickupDelaySql() + " AS pickup_delay")
+	var rows []struct {
+		Priority int
+		AvgDelay float32
+	}
+	err := r.db.Select("tt.priority AS priority, AVG(tt.pickup_delay) AS avg_delay").Table("(?) as tt", subQuery).
+		Group("tt.priority").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[int]float32, len(rows))
+	for _, row := range rows {
+		res[row.Priority] = row.AvgDelay
+	}
+	return res, nil
+}
+
+func (r *OrderRepo) GetAveragePhaseDelay(orderType string) (map[models.OrderStatus]float32, error) {
+	// each transition ends the phase started by previous transition of the order
+	phases := r.db.Table("order_status_history AS h").
+		Select("h.from_status AS status, h.created_at AS ended_at, "+
+			"LAG(h.created_at) OVER (PARTITION BY h.order_id ORDER BY h.id) AS started_at").
+		Joins("JOIN order_models AS o ON o.order_id = h.order_id").
+		Where("o.order_type = ?", orderType)
+	var rows []struct {
+		Status   models.OrderStatus
+		AvgDelay float32
+	}
+	err := r.db.Select("tt.status AS status, AVG("+secondsBetween(r.db.Dialector.Name(), "tt.started_at", "tt.ended_at")+") AS avg_delay").
+		Table("(?) as tt", phases).Where("tt.started_at IS NOT NULL").
+		Group("tt.status").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[models.OrderStatus]float32, len(rows))
+	for _, row := range rows {
+		res[row.Status] = row.AvgDelay
+	}
+	return res, nil
+}
+
+// pickup delay in milliseconds of orders matching filter and start of their period,
+// orders moved on to picked up or delivered are counted by their finish time
+func (r *OrderRepo) finishedDelays(filter *DelayFilter) *gorm.DB {
+	period := "0"
+	if periodSeconds := int64(filter.Period / time.Second); periodSeconds > 0 {
+		period = periodSql(r.db.Dialector.Name(), "f.created_at", periodSeconds)
+	}
+	delays := r.finishedOrders(filter.OrderType).
+		Select(period + " AS period, (" + r.pickupDelaySql() + ") * 1000 AS delay")
+	if !filter.FinishedFrom.IsZero() {
+		delays = delays.Where("f.created_at >= ?", filter.FinishedFrom)
+	}
+	if !filter.FinishedTo.IsZero() {
+		delays = delays.Where("f.created_at < ?", filter.FinishedTo)
+	}
+	return delays
+}
+
+// start time of period returned by finishedDelays
+func periodStart(period int64, filter *DelayFilter) time.Time {
+	periodSeconds := int64(filter.Period / time.Second)
+	if periodSeconds <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(period*periodSeconds, 0)
+}
+
+func (r *OrderRepo) GetDelayHistogram(filter *DelayFilter) ([]*DelayBucketCount, error) {
+	delays := r.finishedDelays(filter)
+	buckets := r.db.Table("(?) AS d", delays).
+		Select("d.period AS period, " + bucketSql("d.delay", filter.Bounds) + " AS bucket, d.delay AS delay")
+
+	var rows []struct {
+		Period   int64
+		Bucket   int
+		Count    int
+		Total    float64
+		MaxDelay float64
+	}
+	err := r.db.Table("(?) AS tt", buckets).
+		Select("tt.period AS period, tt.bucket AS bucket, COUNT(*) AS count, SUM(tt.delay) AS total, " +
+			"MAX(tt.delay) AS max_delay").
+		Group("tt.period, tt.bucket").Order("tt.period, tt.bucket").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*DelayBucketCount, 0, len(rows))
+	for _, row := range rows {
+		res = append(res, &DelayBucketCount{
+			PeriodStart: periodStart(row.Period, filter),
+			Bucket:      row.Bucket,
+			Count:       row.Count,
+			Sum:         row.Total,
+			Max:         row.MaxDelay,
+		})
+	}
+	return res, nil
+}
+
+func (r *OrderRepo) GetDelayPercentiles(filter *DelayFilter, percentiles []int) ([]*DelayPercentile, error) {
+	ranked := r.db.Table("(?) AS d", r.finishedDelays(filter)).
+		Select("d.period AS period, d.delay AS delay, " +
+			"ROW_NUMBER() OVER (PARTITION BY d.period ORDER BY d.delay) AS delay_rank, " +
+			"COUNT(*) OVER (PARTITION BY d.period) AS delay_count")
+	// nearest rank of p is the smallest rank not less than p% of count
+	query := r.db.Table("(?) AS tt", ranked).Select("tt.period AS period, tt.delay AS delay, tt.delay_rank AS delay_rank, tt.delay_count AS delay_count")
+	conditions := r.db
+	for i, p := range percentiles {
+		condition := "tt.delay_rank * 100 >= ? * tt.delay_count AND (tt.delay_rank - 1) * 100 < ? * tt.delay_count"
+		if i == 0 {
+			conditions = conditions.Where(condition, p, p)
+		} else {
+			conditions = conditions.Or(condition, p, p)
+		}
+	}
+	var rows []struct {
+		Period     int64
+		Delay      float64
+		DelayRank  int
+		DelayCount int
+	}
+	err := query.Where(conditions).Order("tt.period, tt.delay_rank").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*DelayPercentile, 0, len(rows)*len(percentiles))
+	for _, row := range rows {
+		for _, p := range percentiles {
+			if row.DelayRank*100 >= p*row.DelayCount && (row.DelayRank-1)*100 < p*row.DelayCount {
+				res = append(res, &DelayPercentile{
+					PeriodStart: periodStart(row.Period, filter),
+					Percentile:  p,
+					Delay:       row.Delay,
+				})
+			}
+		}
+	}
+	return res, nil
+}
+
+func (r *OrderRepo) ListOrders(filter *OrderFilter) (res []*models.OrderModel, err error) {
+	query := r.db.Model(&models.OrderModel{})
+	if len(filter.OrderType) > 0 {
+		query = query.Where("order_type = ?", filter.OrderType)
+	}
+	if filter.OrderStatus != 0 {
+		query = query.Where("order_status = ?", filter.OrderStatus)
+	}
+	if len(filter.CookingOwner) > 0 {
+		query = query.Where("cooking_owner = ?", filter.CookingOwner)
+	}
+	if !filter.CreatedFrom.IsZero() {
+		query = query.Where("created_at >= ?", filter.CreatedFrom)
+	}
+	if !filter.CreatedTo.IsZero() {
+		query = query.Where("created_at < ?", filter.CreatedTo)
+	}
+	if len(filter.Cursor) > 0 {
+		query = query.Where("order_id > ?", filter.Cursor)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	err = query.Order("order_id").Find(&res).Error
+	return
+}
+
+func (r *OrderRepo) CreateOrder(orderModel *models.OrderModel, outbox *models.OutboxMessage) error {
+	orderId, err := r.idGenerator().NextId()
+	if err != nil {
+		return fmt.Errorf("generate id error %v", err)
+	}
+	orderModel.OrderId = orderId
+
+	err = r.db.Transaction(func(tx *gorm.DB) error {
 		var erri error
-		orderModel.OrderId, erri = orderModel.GenerateUniqueKey(tx)
+		// insert nothing if id or order id is duplicated, so it's not an error of transaction.
+		// MySQL can't limit conflict to a column, tell them apart after insert
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(orderModel)
+		if result.Error != nil {
+			return fmt.Errorf("save order error %v", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			var count int64
+			if erri = tx.Model(&models.OrderModel{}).Where("id = ?", orderModel.Id).Count(&count).Error; erri != nil {
+				return fmt.Errorf("check existing order error %v", erri)
+			}
+			if count == 0 {
+				return fmt.Errorf("%w: %s", ErrOrderIdConflict, orderModel.OrderId)
+			}
+			return ErrOrderExists
+		}
+		erri = tx.Create(&models.OrderStatusHistory{
+			OrderId:   orderModel.OrderId,
+			ToStatus:  orderModel.OrderStatus,
+			Actor:     models.ActorApiServer,
+			CreatedAt: orderModel.CreatedAt,
+		}).Error
 		if erri != nil {
-			return fmt.Errorf("generate id error %v", erri)
+			return fmt.Errorf("save order status history error %v", erri)
 		}
-		erri = tx.Create(orderModel).Error
+		if outbox == nil {
+			return nil
+		}
+		outbox.OrderId = orderModel.OrderId
+		erri = tx.Create(outbox).Error
 		if erri != nil {
-			return fmt.Errorf("save order error %v", erri)
+			return fmt.Errorf("save outbox message error %v", erri)
 		}
 		return nil
 	})
 
 	return err
 }
+
+func (r *OrderRepo) TransitionStatus(orderModel *models.OrderModel, to models.OrderStatus, actor string) error {
+	return r.transition(orderModel, to, actor, nil)
+}
+
+func (r *OrderRepo) StartCooking(orderModel *models.OrderModel, owner string, deadline time.Time, actor string) error {
+	err := r.transition(orderModel, models.OrderCooking, actor, map[string]interface{}{
+		"cooking_owner":    owner,
+		"cooking_deadline": deadline,
+	})
+	if err != nil {
+		return err
+	}
+	orderModel.CookingOwner = owner
+	orderModel.CookingDeadline = &deadline
+	return nil
+}
+
+func (r *OrderRepo) ClaimCooking(orderModel *models.OrderModel, owner string) (bool, error) {
+	result := r.db.Model(&models.OrderModel{}).
+		Where("order_id = ? AND order_status = ? AND cooking_owner = ?", orderModel.OrderId, models.OrderCooking, orderModel.CookingOwner).
+		Update("cooking_owner", owner)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	orderModel.CookingOwner = owner
+	return true, nil
+}
+
+// move order to status and update other columns in fields
+func (r *OrderRepo) transition(orderModel *models.OrderModel, to models.OrderStatus, actor string, fields map[string]interface{}) error {
+	from := orderModel.OrderStatus
+	if !models.CanTransition(from, to) {
+		return &models.InvalidTransitionError{OrderId: orderModel.OrderId, From: from, To: to}
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{"order_status": to, "updated_at": now}
+	for column, value := range fields {
+		updates[column] = value
+	}
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// only update if nobody changed status since model was loaded
+		result := tx.Model(&models.OrderModel{}).
+			Where("order_id = ? AND order_status = ?", orderModel.OrderId, from).
+			Updates(updates)
+		if result.Error != nil {
+			return fmt.Errorf("update order status error %v", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			var current models.OrderModel
+			erri := tx.Where("order_id = ?", orderModel.OrderId).First(&current).Error
+			if erri != nil {
+				return fmt.Errorf("reload order error %v", erri)
+			}
+			return &models.InvalidTransitionError{OrderId: orderModel.OrderId, From: current.OrderStatus, To: to}
+		}
+
+		erri := tx.Create(&models.OrderStatusHistory{
+			OrderId:    orderModel.OrderId,
+			FromStatus: from,
+			ToStatus:   to,
+			Actor:      actor,
+			CreatedAt:  now,
+		}).Error
+		if erri != nil {
+			return fmt.Errorf("save order status history error %v", erri)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	orderModel.OrderStatus = to
+	orderModel.UpdatedAt = now
+	return nil
+}
+
+func (r *OrderRepo) GetStatusHistory(orderId string) (res []*models.OrderStatusHistory, err error) {
+	err = r.db.Where("order_id = ?", orderId).Order("created_at, id").Find(&res).Error
+	return
+}
@@ -0,0 +1,273 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/averitas/courier_go/db"
+	"github.com/averitas/courier_go/migrations"
+	"github.com/averitas/courier_go/models"
+)
+
+func TestAverageDelay(t *testing.T) {
+	gormDb, err := db.InitDb("sqlite://file::memory:?cache=shared", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrations.Up(gormDb); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewOrderRepo(gormDb, nil)
+	created := time.Date(2022, 11, 20, 10, 0, 0, 0, time.UTC)
+	scheduled := created.Add(time.Hour)
+	orders := []struct {
+		model *models.OrderModel
+		// time order is finished, zero if it's cancelled before finished
+		finished time.Time
+		// transitions after finished
+		after []models.OrderStatus
+	}{
+		// delay 2s and 4s, delay of delivered order ends when it's finished
+		{&models.OrderModel{Id: "a", OrderType: "fifo", PrepTime: 3}, created.Add(5 * time.Second),
+			[]models.OrderStatus{models.OrderPickedUp, models.OrderDelivered}},
+		{&models.OrderModel{Id: "b", OrderType: "fifo", PrepTime: 3, Priority: 5}, created.Add(7 * time.Second), nil},
+		// delay 6s since scheduled time
+		{&models.OrderModel{Id: "c", OrderType: "fifo", PrepTime: 3, ScheduledAt: &scheduled}, scheduled.Add(6 * time.Second), nil},
+		{&models.OrderModel{Id: "d", OrderType: "match", PrepTime: 3}, created.Add(4 * time.Second), nil},
+		// never finished, not counted
+		{&models.OrderModel{Id: "x", OrderType: "fifo", PrepTime: 3}, time.Time{}, nil},
+	}
+	for _, order := range orders {
+		order.model.OrderStatus = models.OrderStarted
+		if err := repo.CreateOrder(order.model, nil); err != nil {
+			t.Fatal(err)
+		}
+		path := []models.OrderStatus{models.OrderDispatched, models.OrderCooking, models.OrderFinished}
+		if order.finished.IsZero() {
+			path = []models.OrderStatus{models.OrderCancelled}
+		}
+		for _, to := range append(path, order.after...) {
+			if err := repo.TransitionStatus(order.model, to, "test"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := gormDb.Model(order.model).UpdateColumn("created_at", created).Error; err != nil {
+			t.Fatal(err)
+		}
+		err := gormDb.Model(&models.OrderStatusHistory{}).
+			Where("order_id = ? AND to_status = ?", order.model.OrderId, models.OrderFinished).
+			UpdateColumn("created_at", order.finished).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.CreateOrder(&models.OrderModel{Id: "a"}, nil); err != ErrOrderExists {
+		t.Errorf("expected ErrOrderExists, got %v", err)
+	}
+	// another apiserver with same node id generates used order id
+	conflicted := NewOrderRepo(gormDb, fixedIdGenerator(orders[0].model.OrderId))
+	if err := conflicted.CreateOrder(&models.OrderModel{Id: "e"}, nil); !errors.Is(err, ErrOrderIdConflict) {
+		t.Errorf("expected ErrOrderIdConflict, got %v", err)
+	}
+
+	average, err := repo.GetAverageDelayOfOrderType("fifo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if average < 3.99 || average > 4.01 {
+		t.Errorf("expected average delay 4s, got %v", average)
+	}
+
+	byPriority, err := repo.GetAverageDelayByPriority("fifo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byPriority) != 2 || byPriority[0] < 3.99 || byPriority[0] > 4.01 || byPriority[5] < 3.99 || byPriority[5] > 4.01 {
+		t.Errorf("expected average delay 4s of priority 0 and 5, got %v", byPriority)
+	}
+
+	average, err = repo.GetAverageDelayOfOrderType("none")
+	if err != nil || average != 0 {
+		t.Errorf("expected no delay of no orders, got %v %v", average, err)
+	}
+}
+
+func TestAveragePhaseDelay(t *testing.T) {
+	gormDb, err := db.InitDb("sqlite://file:phases?mode=memory&cache=shared", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrations.Up(gormDb); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewOrderRepo(gormDb, nil)
+	start := time.Date(2022, 11, 20, 10, 0, 0, 0, time.UTC)
+	// seconds spent in each status before next one, in order of transitions
+	phases := [][]int{{1, 2, 3}, {3, 4, 5}}
+	path := []models.OrderStatus{models.OrderDispatched, models.OrderCourierArrived, models.OrderCooking}
+	for i, durations := range phases {
+		model := &models.OrderModel{Id: fmt.Sprintf("p%d", i), OrderType: "match", OrderStatus: models.OrderStarted}
+		if err := repo.CreateOrder(model, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, to := range path {
+			if err := repo.TransitionStatus(model, to, "test"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		history, err := repo.GetStatusHistory(model.OrderId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := start
+		for j, h := range history {
+			if j > 0 {
+				at = at.Add(time.Duration(durations[j-1]) * time.Second)
+			}
+			if err := gormDb.Model(h).UpdateColumn("created_at", at).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	byPhase, err := repo.GetAveragePhaseDelay("match")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[models.OrderStatus]float32{
+		models.OrderStarted:        2,
+		models.OrderDispatched:     3,
+		models.OrderCourierArrived: 4,
+	}
+	if len(byPhase) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, byPhase)
+	}
+	for status, delay := range expected {
+		if byPhase[status] < delay-0.01 || byPhase[status] > delay+0.01 {
+			t.Errorf("expected %v stays %vs, got %v", status, delay, byPhase[status])
+		}
+	}
+}
+
+func TestDelayHistogram(t *testing.T) {
+	gormDb, err := db.InitDb("sqlite://file:histogram?mode=memory&cache=shared", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrations.Up(gormDb); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewOrderRepo(gormDb, nil)
+	start := time.Date(2022, 11, 20, 10, 0, 0, 0, time.UTC)
+	orders := []struct {
+		// transitions after started, orders not finished aren't counted
+		path       []models.OrderStatus
+		finishedAt time.Time
+		delay      time.Duration
+	}{
+		// picked up and delivered after finished, still counted by finish time
+		{[]models.OrderStatus{models.OrderDispatched, models.OrderCooking, models.OrderFinished, models.OrderPickedUp, models.OrderDelivered},
+			start.Add(10 * time.Second), 30 * time.Millisecond},
+		{[]models.OrderStatus{models.OrderDispatched, models.OrderCooking, models.OrderFinished},
+			start.Add(20 * time.Second), 80 * time.Millisecond},
+		{[]models.OrderStatus{models.OrderDispatched, models.OrderCooking, models.OrderFinished, models.OrderPickedUp},
+			start.Add(70 * time.Second), 2 * time.Second},
+		// out of window
+		{[]models.OrderStatus{models.OrderDispatched, models.OrderCooking, models.OrderFinished},
+			start.Add(-time.Minute), time.Second},
+		// not finished
+		{[]models.OrderStatus{models.OrderDispatched, models.OrderCooking, models.OrderCancelled},
+			start.Add(30 * time.Second), time.Second},
+	}
+	for i, order := range orders {
+		model := &models.OrderModel{Id: fmt.Sprintf("h%d", i), OrderType: "fifo", OrderStatus: models.OrderStarted, PrepTime: 1}
+		if err := repo.CreateOrder(model, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, to := range order.path {
+			if err := repo.TransitionStatus(model, to, "test"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := gormDb.Model(model).UpdateColumn("created_at", order.finishedAt.Add(-time.Second-order.delay)).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = gormDb.Model(&models.OrderStatusHistory{}).
+			Where("order_id = ? AND to_status = ?", model.OrderId, models.OrderFinished).
+			UpdateColumn("created_at", order.finishedAt).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts, err := repo.GetDelayHistogram(&DelayFilter{
+		OrderType:    "fifo",
+		FinishedFrom: start,
+		FinishedTo:   start.Add(2 * time.Minute),
+		Period:       time.Minute,
+		Bounds:       []float64{50, 100},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DelayBucketCount{
+		{PeriodStart: start, Bucket: 0, Count: 1, Sum: 30, Max: 30},
+		{PeriodStart: start, Bucket: 1, Count: 1, Sum: 80, Max: 80},
+		{PeriodStart: start.Add(time.Minute), Bucket: 2, Count: 1, Sum: 2000, Max: 2000},
+	}
+	if len(counts) != len(expected) {
+		t.Fatalf("expected %d buckets, got %d", len(expected), len(counts))
+	}
+	for i, count := range counts {
+		e := expected[i]
+		if !count.PeriodStart.Equal(e.PeriodStart) || count.Bucket != e.Bucket || count.Count != e.Count ||
+			math.Abs(count.Sum-e.Sum) > 1 || math.Abs(count.Max-e.Max) > 1 {
+			t.Errorf("expected %+v, got %+v", e, *count)
+		}
+	}
+
+	// nearest rank of delays 30 and 80 in the first minute, 2000 in the second one
+	filter := &DelayFilter{OrderType: "fifo", FinishedFrom: start, FinishedTo: start.Add(2 * time.Minute), Period: time.Minute}
+	percentiles, err := repo.GetDelayPercentiles(filter, []int{50, 90, 99})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPercentiles := []DelayPercentile{
+		{start, 50, 30}, {start, 90, 80}, {start, 99, 80},
+		{start.Add(time.Minute), 50, 2000}, {start.Add(time.Minute), 90, 2000}, {start.Add(time.Minute), 99, 2000},
+	}
+	checkPercentiles := func(percentiles []*DelayPercentile, expected []DelayPercentile) {
+		if len(percentiles) != len(expected) {
+			t.Fatalf("expected %d percentiles, got %d", len(expected), len(percentiles))
+		}
+		for i, percentile := range percentiles {
+			e := expected[i]
+			if !percentile.PeriodStart.Equal(e.PeriodStart) || percentile.Percentile != e.Percentile || math.Abs(percentile.Delay-e.Delay) > 1 {
+				t.Errorf("expected %+v, got %+v", e, *percentile)
+			}
+		}
+	}
+	checkPercentiles(percentiles, expectedPercentiles)
+
+	// not grouped
+	filter.Period = 0
+	percentiles, err = repo.GetDelayPercentiles(filter, []int{50, 90, 99})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPercentiles(percentiles, []DelayPercentile{{time.Time{}, 50, 80}, {time.Time{}, 90, 2000}, {time.Time{}, 99, 2000}})
+}
+
+// generate the same order id every time
+type fixedIdGenerator string
+
+func (g fixedIdGenerator) NextId() (string, error) {
+	return string(g), nil
+}
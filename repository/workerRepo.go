@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/averitas/courier_go/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type IWorkerRepo interface {
+	// Save heartbeat of worker @field WorkerHeartbeat.Owner
+	Heartbeat(*models.WorkerHeartbeat) error
+	// List workers whose last heartbeat is before time
+	ListDeadWorkers(time.Time) ([]*models.WorkerHeartbeat, error)
+	// Delete worker by @field WorkerHeartbeat.Owner if it didn't heartbeat since it was listed
+	DeleteWorker(*models.WorkerHeartbeat) error
+}
+
+type WorkerRepo struct {
+	db *gorm.DB
+}
+
+// @description create worker repository on database
+// @param gormDb *gorm.DB
+// @return *WorkerRepo
+func NewWorkerRepo(gormDb *gorm.DB) *WorkerRepo {
+	return &WorkerRepo{db: gormDb}
+}
+
+func (r *WorkerRepo) Heartbeat(worker *models.WorkerHeartbeat) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "owner"}},
+		DoUpdates: clause.AssignmentColumns([]string{"heartbeat_at"}),
+	}).Create(worker).Error
+}
+
+func (r *WorkerRepo) ListDeadWorkers(before time.Time) (res []*models.WorkerHeartbeat, err error) {
+	err = r.db.Where("heartbeat_at < ?", before).Find(&res).Error
+	return
+}
+
+func (r *WorkerRepo) DeleteWorker(worker *models.WorkerHeartbeat) error {
+	return r.db.Where("owner = ? AND heartbeat_at = ?", worker.Owner, worker.HeartbeatAt).
+		Delete(&models.WorkerHeartbeat{}).Error
+}
@@ -7,20 +7,29 @@ import (
 	"sync"
 	"time"
 
-	"github.com/averitas/courier_go/db"
 	"github.com/averitas/courier_go/handlers"
+	"github.com/averitas/courier_go/migrations"
+	"github.com/averitas/courier_go/models"
 	"github.com/averitas/courier_go/repository"
 	"github.com/averitas/courier_go/services"
 	"github.com/averitas/courier_go/tools"
 	"github.com/averitas/courier_go/tools/logger"
 	"github.com/averitas/courier_go/types"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 type Server struct {
-	queueManager *tools.RabbitMqManager
-	handler      *handlers.ServerHandler
-	serverInst   *http.Server
+	queueManager tools.IQueueBackend
+	// broadcast order cancellation to workers
+	cancelQueueManager tools.IQueueBackend
+	registry           *services.CourierRegistry
+	idempotency        *services.IdempotencyService
+	outboxRelay        *services.OutboxRelay
+	handler            *handlers.ServerHandler
+	serverInst         *http.Server
+
+	probeInterval time.Duration
 
 	waitGroup *sync.WaitGroup
 }
@@ -30,9 +39,15 @@ func (s *Server) StartAndWait(ctx context.Context) {
 	if err != nil {
 		panic(fmt.Sprintf("init queue error: %v", err))
 	}
+	err = s.cancelQueueManager.Init()
+	if err != nil {
+		panic(fmt.Sprintf("init cancel queue error: %v", err))
+	}
 
-	// add two wait group: 1. api server, 2. background queue sender
-	s.waitGroup.Add(2)
+	// add seven wait group: 1. api server, 2. background queue sender,
+	// 3. cancel queue sender, 4. courier evictor, 5. courier health prober,
+	// 6. idempotency key cleaner, 7. outbox relay
+	s.waitGroup.Add(7)
 
 	go func() {
 		defer func() {
@@ -41,6 +56,41 @@ func (s *Server) StartAndWait(ctx context.Context) {
 		s.queueManager.StartSender(ctx)
 	}()
 
+	go func() {
+		defer func() {
+			s.waitGroup.Done()
+		}()
+		s.cancelQueueManager.StartSender(ctx)
+	}()
+
+	go func() {
+		defer func() {
+			s.waitGroup.Done()
+		}()
+		s.registry.StartEvictor(ctx)
+	}()
+
+	go func() {
+		defer func() {
+			s.waitGroup.Done()
+		}()
+		s.registry.StartProber(ctx, http.DefaultClient, s.probeInterval)
+	}()
+
+	go func() {
+		defer func() {
+			s.waitGroup.Done()
+		}()
+		s.idempotency.StartCleaner(ctx)
+	}()
+
+	go func() {
+		defer func() {
+			s.waitGroup.Done()
+		}()
+		s.outboxRelay.Start(ctx)
+	}()
+
 	// Initializing the server in a goroutine so that
 	// it won't block the graceful shutdown handling below
 	go func() {
@@ -58,34 +108,88 @@ func (s *Server) StartAndWait(ctx context.Context) {
 	// done with api server shutdown
 	s.waitGroup.Done()
 
-	// wait api server and queue sender
+	// wait api server, queue senders, courier evictor, prober, idempotency key cleaner and outbox relay
 	s.waitGroup.Wait()
 	logger.InfoLogger.Println("Server stopped")
 }
 
-func CreateServer(addr, queueConnString, dsn string, couriers []string) *Server {
+// relay of orders not dispatched by requests
+type OutboxOptions struct {
+	Interval    time.Duration
+	MaxAttempts int
+}
+
+// courier registry and health check configurations
+type CourierOptions struct {
+	Couriers           []string
+	Dispatch           string
+	Capacity           map[string]int
+	HeartbeatTimeout   time.Duration
+	ProbeInterval      time.Duration
+	UnhealthyThreshold int
+	// timeout, retry and circuit breaker of calling courier api
+	HttpOptions tools.ResilientOptions
+}
+
+func CreateServer(addr, queueConnString string, gormDb *gorm.DB, idGenerator models.IdGenerator, idempotencyTTL time.Duration, outboxOptions *OutboxOptions, courierOptions *CourierOptions) *Server {
 	var router = gin.Default()
 
 	// init thrid party tools managers
-	queueManager := &tools.RabbitMqManager{
-		QueueName:  types.QueueName,
-		ConnString: queueConnString,
+	queueManager := tools.NewQueueManager(queueConnString, tools.QueueOptions{
+		QueueName:   types.QueueName,
+		MaxPriority: types.MaxPriority,
+	})
+	cancelQueueManager := tools.NewQueueManager(queueConnString, tools.QueueOptions{
+		ExchangeName: types.CancelExchangeName,
+	})
+
+	// check db
+	if err := migrations.CheckVersion(gormDb); err != nil {
+		panic(fmt.Sprintf("check database schema error: %v", err))
 	}
 
-	// init db
-	db.InitDb(dsn)
+	// init courier registry and dispatcher
+	registry := services.NewCourierRegistry(courierOptions.Couriers, courierOptions.Capacity, courierOptions.HeartbeatTimeout)
+	registry.UnhealthyThreshold = courierOptions.UnhealthyThreshold
+	dispatcher, err := services.NewDispatcher(courierOptions.Dispatch, registry)
+	if err != nil {
+		panic(err)
+	}
+
+	// http client to call courier api
+	httpClient := tools.NewResilientHttpClient(http.DefaultClient, courierOptions.HttpOptions)
 
 	// init Service
 	orderService := &services.OrderService{
-		HttpClient:   http.DefaultClient,
+		HttpClient:   httpClient,
 		QueueManager: queueManager,
-		CouriersUrl:  couriers,
-		Repo:         &repository.OrderRepo{},
+		CouriersUrl:  courierOptions.Couriers,
+		Repo:         repository.NewOrderRepo(gormDb, idGenerator),
+		Dispatcher:   dispatcher,
+		Registry:     registry,
+		Actor:        models.ActorApiServer,
+		Outbox:       repository.NewOutboxRepo(gormDb),
+
+		CancelQueueManager: cancelQueueManager,
+	}
+	outboxRelay := &services.OutboxRelay{
+		Repo:         orderService.Outbox,
+		OrderService: orderService,
+		Interval:     outboxOptions.Interval,
+		BatchSize:    100,
+		MaxAttempts:  outboxOptions.MaxAttempts,
+	}
+
+	idempotency := &services.IdempotencyService{
+		Repo: repository.NewIdempotencyRepo(gormDb),
+		TTL:  idempotencyTTL,
 	}
 
 	// init api server controller
 	handler := &handlers.ServerHandler{
 		OrderService: orderService,
+		Idempotency:  idempotency,
+		HttpClient:   httpClient,
 	}
 
 	// init api routers
@@ -97,10 +201,16 @@ func CreateServer(addr, queueConnString, dsn string, couriers []string) *Server
 	}
 
 	return &Server{
-		queueManager: queueManager,
-		serverInst:   server,
-		handler:      handler,
-		waitGroup:    &sync.WaitGroup{},
+		queueManager:       queueManager,
+		cancelQueueManager: cancelQueueManager,
+		registry:           registry,
+		idempotency:        idempotency,
+		outboxRelay:        outboxRelay,
+		serverInst:         server,
+		handler:            handler,
+		waitGroup:          &sync.WaitGroup{},
+
+		probeInterval: courierOptions.ProbeInterval,
 	}
 }
 
@@ -115,4 +225,19 @@ func configureRouters(gEngin *gin.Engine, handler *handlers.ServerHandler) {
 	api.POST("sendOrder/random", handler.ReceiveOrder)
 	api.POST("sendOrder/fifo", handler.ReceiveOrderFIFO)
 	api.GET("delay/:orderType", handler.QueryAverageDelay)
+	api.GET("delay/:orderType/stats", handler.QueryDelayStats)
+	api.GET("orders", handler.ListOrders)
+	api.GET("orders/:id", handler.QueryOrder)
+	api.POST("orders/:id/cancel", handler.CancelOrder)
+	api.POST("orders/:id/pickup", handler.PickUpOrder)
+	api.POST("orders/:id/deliver", handler.DeliverOrder)
+
+	// courier registry api, called by workers
+	api.GET("couriers", handler.ListCouriers)
+	api.POST("couriers/register", handler.RegisterCourier)
+	api.POST("couriers/heartbeat", handler.CourierHeartbeat)
+	api.POST("couriers/deregister", handler.DeregisterCourier)
+
+	// admin api
+	api.GET("admin/breakers", handler.ListBreakers)
 }
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/averitas/courier_go/models"
+	"github.com/averitas/courier_go/repository"
+	"github.com/averitas/courier_go/tools/logger"
+)
+
+// CookingReaper keep orders cooking when workers restart or crash. It saves heartbeat of
+// OrderService.Owner, resumes orders still cooking by the owner on start, and takes over
+// cooking orders of workers stopped heartbeating. Orders taken over after their deadline
+// are failed, since nobody finished them in time.
+type CookingReaper struct {
+	Repo         repository.IWorkerRepo
+	OrderService *OrderService
+	// interval of heartbeat and taking over orders
+	Interval time.Duration
+	// worker is dead if it doesn't heartbeat in this duration
+	Timeout time.Duration
+
+	cooking sync.WaitGroup
+}
+
+// @description resume orders of this worker, then heartbeat and take over orders of
+// dead workers every Interval until ctx is done. It returns after resumed orders stopped.
+// @param ctx context.Context
+func (r *CookingReaper) Start(ctx context.Context) {
+	r.heartbeat()
+	if err := r.resume(ctx); err != nil {
+		logger.ErrorLogger.Printf("resume cooking orders error: %v\n", err)
+	}
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.cooking.Wait()
+			logger.InfoLogger.Println("background cooking reaper stopped")
+			return
+		case <-ticker.C:
+			r.heartbeat()
+			if err := r.ReapOnce(ctx); err != nil {
+				logger.ErrorLogger.Printf("take over cooking orders error: %v\n", err)
+			}
+		}
+	}
+}
+
+// @description take over cooking orders of workers stopped heartbeating
+// @param ctx context.Context cooking of orders taken over stops when ctx is done
+// @return error
+func (r *CookingReaper) ReapOnce(ctx context.Context) error {
+	workers, err := r.Repo.ListDeadWorkers(time.Now().Add(-r.Timeout))
+	if err != nil {
+		return fmt.Errorf("list dead workers error: %v", err)
+	}
+	for _, worker := range workers {
+		if worker.Owner == r.OrderService.Owner {
+			continue
+		}
+		orders, err := r.cookingOrders(worker.Owner)
+		if err != nil {
+			return err
+		}
+		logger.WarningLogger.Printf("worker [%s] stopped heartbeat since %v, take over its %d orders\n",
+			worker.Owner, worker.HeartbeatAt, len(orders))
+		for _, order := range orders {
+			if err := r.takeOver(ctx, order); err != nil {
+				return err
+			}
+		}
+		// worker is forgotten after its orders are taken over, unless it heartbeat again
+		if err := r.Repo.DeleteWorker(worker); err != nil {
+			return fmt.Errorf("delete worker [%s] error: %v", worker.Owner, err)
+		}
+	}
+	return nil
+}
+
+func (r *CookingReaper) takeOver(ctx context.Context, model *models.OrderModel) error {
+	claimed, err := r.OrderService.Repo.ClaimCooking(model, r.OrderService.Owner)
+	if err != nil {
+		return fmt.Errorf("claim order [%s] error: %v", model.OrderId, err)
+	}
+	if !claimed {
+		// finished by owner restarted, or taken over by others
+		return nil
+	}
+
+	if model.CookingDeadline == nil || model.CookingDeadline.Before(time.Now()) {
+		logger.WarningLogger.Printf("order [%s] of dead worker passed its deadline, fail it\n", model.OrderId)
+		if err := r.OrderService.TransitionOrder(model, models.OrderFailed); err != nil {
+			logger.ErrorLogger.Printf("set order [%s] status to failed error: %v\n", model.OrderId, err)
+		}
+		return nil
+	}
+	r.cook(ctx, model)
+	return nil
+}
+
+// resume orders cooking by this worker before it restarted
+func (r *CookingReaper) resume(ctx context.Context) error {
+	orders, err := r.cookingOrders(r.OrderService.Owner)
+	if err != nil {
+		return err
+	}
+	for _, order := range orders {
+		r.cook(ctx, order)
+	}
+	return nil
+}
+
+func (r *CookingReaper) cook(ctx context.Context, model *models.OrderModel) {
+	r.cooking.Add(1)
+	go func() {
+		defer r.cooking.Done()
+		if err := r.OrderService.WaitUntilOrderCooked(ctx, model); err != nil {
+			logger.ErrorLogger.Printf("cook order [%s] error: %v\n", model.OrderId, err)
+		}
+	}()
+}
+
+func (r *CookingReaper) cookingOrders(owner string) ([]*models.OrderModel, error) {
+	orders, err := r.OrderService.Repo.ListOrders(&repository.OrderFilter{
+		OrderStatus:  models.OrderCooking,
+		CookingOwner: owner,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list cooking orders of [%s] error: %v", owner, err)
+	}
+	return orders, nil
+}
+
+func (r *CookingReaper) heartbeat() {
+	err := r.Repo.Heartbeat(&models.WorkerHeartbeat{
+		Owner:       r.OrderService.Owner,
+		HeartbeatAt: time.Now(),
+	})
+	if err != nil {
+		logger.ErrorLogger.Printf("save heartbeat of worker [%s] error: %v\n", r.OrderService.Owner, err)
+	}
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/averitas/courier_go/mocks"
+	"github.com/averitas/courier_go/models"
+	"github.com/averitas/courier_go/repository"
+	"github.com/golang/mock/gomock"
+)
+
+func TestCookingReaper(t *testing.T) {
+	mockCtrl = gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	setup()
+	testService.Owner = "worker1"
+	workerRepo := mocks.NewMockIWorkerRepo(mockCtrl)
+	reaper := &CookingReaper{
+		Repo:         workerRepo,
+		OrderService: testService,
+		Interval:     time.Second,
+		Timeout:      10 * time.Second,
+	}
+
+	// mock structs
+	dead := &models.WorkerHeartbeat{Owner: "worker2", HeartbeatAt: time.Now().Add(-time.Minute)}
+	past := time.Now().Add(-time.Second)
+	soon := time.Now().Add(100 * time.Millisecond)
+	expired := &models.OrderModel{
+		OrderId:         "ORDER000000001",
+		OrderStatus:     models.OrderCooking,
+		CookingOwner:    dead.Owner,
+		CookingDeadline: &past,
+	}
+	cooking := &models.OrderModel{
+		OrderId:         "ORDER000000002",
+		OrderStatus:     models.OrderCooking,
+		CookingOwner:    dead.Owner,
+		CookingDeadline: &soon,
+	}
+	claim := func(m *models.OrderModel, owner string) (bool, error) {
+		m.CookingOwner = owner
+		return true, nil
+	}
+
+	// order passed deadline is failed, the other is cooked until its deadline
+	finished := make(chan interface{})
+	gomock.InOrder(
+		workerRepo.EXPECT().ListDeadWorkers(gomock.Any()).Return([]*models.WorkerHeartbeat{dead}, nil),
+		mockRepo.EXPECT().ListOrders(gomock.Eq(&repository.OrderFilter{
+			OrderStatus:  models.OrderCooking,
+			CookingOwner: dead.Owner,
+		})).Return([]*models.OrderModel{expired, cooking}, nil),
+		mockRepo.EXPECT().ClaimCooking(expired, "worker1").DoAndReturn(claim),
+		mockRepo.EXPECT().TransitionStatus(expired, models.OrderFailed, gomock.Any()).Return(nil),
+		mockRepo.EXPECT().ClaimCooking(cooking, "worker1").DoAndReturn(claim),
+	)
+	workerRepo.EXPECT().DeleteWorker(dead).Return(nil)
+	mockRepo.EXPECT().TransitionStatus(cooking, models.OrderFinished, gomock.Any()).DoAndReturn(
+		func(m *models.OrderModel, to models.OrderStatus, actor string) error {
+			close(finished)
+			return nil
+		})
+
+	if err := reaper.ReapOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Errorf("order taken over is not finished")
+	}
+	reaper.cooking.Wait()
+
+	tearDown()
+}
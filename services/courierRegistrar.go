@@ -0,0 +1,109 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/averitas/courier_go/tools"
+	"github.com/averitas/courier_go/tools/logger"
+	"github.com/averitas/courier_go/types"
+)
+
+// CourierRegistrar is used by worker to register itself to apiserver,
+// keep sending heartbeats and deregister when worker stops
+type CourierRegistrar struct {
+	HttpClient   tools.HttpClient
+	ApiServerUrl string
+	// url that apiserver use to call this courier
+	CourierUrl        string
+	Capacity          int
+	HeartbeatInterval time.Duration
+}
+
+// @description register courier, then send heartbeat every HeartbeatInterval
+// until ctx is done, then deregister. Courier register again if apiserver
+// doesn't know it any more, e.g. apiserver restarted or courier was evicted.
+// @param ctx context.Context
+func (c *CourierRegistrar) Run(ctx context.Context) {
+	registered := false
+	ticker := time.NewTicker(c.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		if registered {
+			err = c.call("heartbeat")
+			if err == ErrCourierNotRegistered {
+				logger.WarningLogger.Printf("apiserver lost courier [%s], register again\n", c.CourierUrl)
+				registered = false
+			}
+		}
+		if !registered {
+			err = c.call("register")
+			registered = err == nil
+		}
+		if err != nil {
+			logger.ErrorLogger.Printf("courier [%s] call apiserver error: %v\n", c.CourierUrl, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			if registered {
+				if err := c.call("deregister"); err != nil {
+					logger.ErrorLogger.Printf("courier [%s] deregister error: %v\n", c.CourierUrl, err)
+				}
+			}
+			logger.InfoLogger.Println("background courier registrar stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *CourierRegistrar) call(action string) error {
+	targetUrl, err := url.Parse(c.ApiServerUrl)
+	if err != nil {
+		return fmt.Errorf("configured apiserver url %v is invalid", c.ApiServerUrl)
+	}
+	targetUrl.Path = path.Join(targetUrl.Path, "api", "couriers", action)
+
+	body, err := json.Marshal(&types.CourierRegistration{
+		Url:      c.CourierUrl,
+		Capacity: c.Capacity,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal courier registration error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.HeartbeatInterval)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, targetUrl.String(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("generate http request to url [%s] error: %v", targetUrl.String(), err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.HttpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("call url [%s] error: %v", targetUrl.String(), err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return ErrCourierNotRegistered
+	}
+	if res.StatusCode >= 300 {
+		buf := new(strings.Builder)
+		io.Copy(buf, res.Body)
+		return fmt.Errorf("call apiserver %s got status: %v error: %s", action, res.StatusCode, buf.String())
+	}
+	return nil
+}
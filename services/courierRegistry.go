@@ -0,0 +1,257 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/averitas/courier_go/tools"
+	"github.com/averitas/courier_go/tools/logger"
+	"github.com/averitas/courier_go/types"
+)
+
+var ErrCourierNotRegistered = fmt.Errorf("courier is not registered")
+
+// CourierRegistry keep the couriers that apiserver could dispatch "match" orders to.
+// Static couriers come from command line and never expire, other couriers
+// register themselves and are evicted when they miss heartbeats.
+// Courier is unhealthy after UnhealthyThreshold consecutive failures and
+// back to rotation when health probe succeed.
+type CourierRegistry struct {
+	HeartbeatTimeout   time.Duration
+	UnhealthyThreshold int
+
+	mu       sync.RWMutex
+	couriers map[string]*types.CourierInfo
+
+	// used to mock time in tests
+	now func() time.Time
+}
+
+// @description create registry with static couriers
+// @param static []string courier urls configured by command line
+// @param capacity map[string]int capacity of static couriers
+// @param heartbeatTimeout time.Duration courier is evicted if no heartbeat in this duration
+// @return *CourierRegistry
+func NewCourierRegistry(static []string, capacity map[string]int, heartbeatTimeout time.Duration) *CourierRegistry {
+	r := &CourierRegistry{
+		HeartbeatTimeout:   heartbeatTimeout,
+		UnhealthyThreshold: 1,
+		couriers:           make(map[string]*types.CourierInfo),
+		now:                time.Now,
+	}
+	for _, url := range static {
+		if len(url) == 0 {
+			continue
+		}
+		r.couriers[url] = &types.CourierInfo{
+			Url:      url,
+			Capacity: capacity[url],
+			Static:   true,
+			Healthy:  true,
+		}
+	}
+	return r
+}
+
+// Register add courier or refresh its capacity and heartbeat
+func (r *CourierRegistry) Register(url string, capacity int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if courier, ok := r.couriers[url]; ok {
+		courier.Capacity = capacity
+		courier.LastHeartbeat = r.now()
+		return
+	}
+	r.couriers[url] = &types.CourierInfo{
+		Url:           url,
+		Capacity:      capacity,
+		LastHeartbeat: r.now(),
+		Healthy:       true,
+	}
+	logger.InfoLogger.Printf("Courier [%s] registered with capacity %d\n", url, capacity)
+}
+
+// Heartbeat refresh courier, return ErrCourierNotRegistered if courier is unknown
+// or already evicted, then courier should register again
+func (r *CourierRegistry) Heartbeat(url string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	courier, ok := r.couriers[url]
+	if !ok {
+		return ErrCourierNotRegistered
+	}
+	courier.LastHeartbeat = r.now()
+	return nil
+}
+
+// Deregister remove courier, static couriers could be removed as well
+func (r *CourierRegistry) Deregister(url string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.couriers[url]; ok {
+		delete(r.couriers, url)
+		logger.InfoLogger.Printf("Courier [%s] deregistered\n", url)
+	}
+}
+
+// List return urls of all alive and healthy couriers in stable order
+func (r *CourierRegistry) List() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := make([]string, 0, len(r.couriers))
+	for url, courier := range r.couriers {
+		if r.aliveLocked(courier) && courier.Healthy {
+			res = append(res, url)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Couriers return a copy of all courier info
+func (r *CourierRegistry) Couriers() []types.CourierInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := make([]types.CourierInfo, 0, len(r.couriers))
+	for _, courier := range r.couriers {
+		res = append(res, *courier)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Url < res[j].Url })
+	return res
+}
+
+// Capacity return capacity of courier, 0 if unknown
+func (r *CourierRegistry) Capacity(url string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if courier, ok := r.couriers[url]; ok {
+		return courier.Capacity
+	}
+	return 0
+}
+
+// ReportFailure record a failure of courier, mark it unhealthy
+// if it failed UnhealthyThreshold times in a row
+func (r *CourierRegistry) ReportFailure(url string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	courier, ok := r.couriers[url]
+	if !ok {
+		return
+	}
+	courier.Failures++
+	if courier.Healthy && courier.Failures >= r.UnhealthyThreshold {
+		courier.Healthy = false
+		logger.WarningLogger.Printf("Courier [%s] is unhealthy after %d failures\n", url, courier.Failures)
+	}
+}
+
+// ReportSuccess reset failures of courier and put it back to rotation
+func (r *CourierRegistry) ReportSuccess(url string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	courier, ok := r.couriers[url]
+	if !ok {
+		return
+	}
+	courier.Failures = 0
+	if !courier.Healthy {
+		courier.Healthy = true
+		logger.InfoLogger.Printf("Courier [%s] is healthy again\n", url)
+	}
+}
+
+// @description call GET {courier}/ping of every courier periodically until ctx is done,
+// couriers answered are healthy, others get a failure
+// @param ctx context.Context
+// @param client tools.HttpClient
+// @param interval time.Duration
+func (r *CourierRegistry) StartProber(ctx context.Context, client tools.HttpClient, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.InfoLogger.Println("background courier prober stopped")
+			return
+		case <-ticker.C:
+			for _, courier := range r.Couriers() {
+				if err := probeCourier(ctx, client, courier.Url, interval); err != nil {
+					r.ReportFailure(courier.Url)
+				} else {
+					r.ReportSuccess(courier.Url)
+				}
+			}
+		}
+	}
+}
+
+func probeCourier(ctx context.Context, client tools.HttpClient, courierUrl string, timeout time.Duration) error {
+	targetUrl, err := url.Parse(courierUrl)
+	if err != nil {
+		return fmt.Errorf("configured url %v is invalid", courierUrl)
+	}
+	targetUrl.Path = path.Join(targetUrl.Path, "ping")
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("ping courier got status %v", res.StatusCode)
+	}
+	return nil
+}
+
+// EvictExpired remove couriers that missed heartbeats
+func (r *CourierRegistry) EvictExpired() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for url, courier := range r.couriers {
+		if !r.aliveLocked(courier) {
+			delete(r.couriers, url)
+			logger.WarningLogger.Printf("Courier [%s] evicted, last heartbeat at %v\n", url, courier.LastHeartbeat)
+		}
+	}
+}
+
+// StartEvictor evict expired couriers periodically until ctx is done
+func (r *CourierRegistry) StartEvictor(ctx context.Context) {
+	ticker := time.NewTicker(r.HeartbeatTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.InfoLogger.Println("background courier evictor stopped")
+			return
+		case <-ticker.C:
+			r.EvictExpired()
+		}
+	}
+}
+
+func (r *CourierRegistry) aliveLocked(courier *types.CourierInfo) bool {
+	return courier.Static || r.now().Sub(courier.LastHeartbeat) <= r.HeartbeatTimeout
+}
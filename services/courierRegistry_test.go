@@ -0,0 +1,44 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCourierRegistryEvict(t *testing.T) {
+	now := time.Now()
+	registry := NewCourierRegistry([]string{"http://static.com"}, nil, 10*time.Second)
+	registry.now = func() time.Time { return now }
+
+	registry.Register("http://a.com", 2)
+	registry.Register("http://b.com", 1)
+	if couriers := registry.List(); len(couriers) != 3 {
+		t.Errorf("expected 3 couriers, got %v", couriers)
+	}
+	if registry.Capacity("http://a.com") != 2 {
+		t.Errorf("expected capacity 2, got %d", registry.Capacity("http://a.com"))
+	}
+
+	// only courier a keeps heartbeat
+	now = now.Add(6 * time.Second)
+	if err := registry.Heartbeat("http://a.com"); err != nil {
+		t.Error(err)
+	}
+	now = now.Add(6 * time.Second)
+	couriers := registry.List()
+	if len(couriers) != 2 || couriers[0] != "http://a.com" || couriers[1] != "http://static.com" {
+		t.Errorf("courier b should not be alive, got %v", couriers)
+	}
+
+	// evicted courier should register again
+	registry.EvictExpired()
+	if err := registry.Heartbeat("http://b.com"); err != ErrCourierNotRegistered {
+		t.Errorf("expected not registered error, got %v", err)
+	}
+
+	registry.Deregister("http://a.com")
+	couriers = registry.List()
+	if len(couriers) != 1 || couriers[0] != "http://static.com" {
+		t.Errorf("expected only static courier, got %v", couriers)
+	}
+}
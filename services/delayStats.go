@@ -0,0 +1,184 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/averitas/courier_go/repository"
+	"github.com/averitas/courier_go/types"
+)
+
+// returned by GetDelayStats if groupBy or time window is invalid
+var ErrInvalidDelayQuery = fmt.Errorf("invalid delay stats query")
+
+// upper bounds of histogram buckets in milliseconds, delays above the last one are in an unbounded bucket
+var delayHistogramBounds = []float64{50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+var delayGroupDurations = map[string]time.Duration{
+	types.GroupByMinute: time.Minute,
+	types.GroupByHour:   time.Hour,
+}
+
+// percentiles returned in DelayStats
+var delayPercentiles = []int{50, 90, 99}
+
+// at most this many time buckets are returned, e.g. a day by minute
+const maxDelayGroups = 1440
+
+// @description get pickup delay statistics of orders of order type
+// finished in [from, to), including orders picked up or delivered since then,
+// optionally grouped into minute or hour buckets.
+// Count, mean, max, histogram and exact nearest-rank percentiles are aggregated by database
+// @param orderType string
+// @param from time.Time zero for no lower bound, required by groupBy
+// @param to time.Time zero for no upper bound, now if grouped
+// @param groupBy string empty, minute or hour
+// @return *types.DelayStatsResult
+// @return error ErrInvalidDelayQuery if groupBy or time window is invalid
+func (o *OrderService) GetDelayStats(orderType string, from, to time.Time, groupBy string) (*types.DelayStatsResult, error) {
+	var period time.Duration
+	if len(groupBy) > 0 {
+		var ok bool
+		if period, ok = delayGroupDurations[groupBy]; !ok {
+			return nil, fmt.Errorf("%w: groupBy should be %s or %s", ErrInvalidDelayQuery, types.GroupByMinute, types.GroupByHour)
+		}
+		if from.IsZero() {
+			return nil, fmt.Errorf("%w: from is required by groupBy", ErrInvalidDelayQuery)
+		}
+		if to.IsZero() {
+			to = time.Now()
+		}
+		if to.Sub(from) > maxDelayGroups*period {
+			return nil, fmt.Errorf("%w: at most %d %s buckets in [from, to)", ErrInvalidDelayQuery, maxDelayGroups, groupBy)
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return nil, fmt.Errorf("%w: from should be before to", ErrInvalidDelayQuery)
+	}
+
+	filter := &repository.DelayFilter{
+		OrderType:    orderType,
+		FinishedFrom: from,
+		FinishedTo:   to,
+		Period:       period,
+		Bounds:       delayHistogramBounds,
+	}
+	counts, err := o.Repo.GetDelayHistogram(filter)
+	if err != nil {
+		return nil, fmt.Errorf("get delay histogram error: %v", err)
+	}
+
+	res := &types.DelayStatsResult{
+		OrderType: orderType,
+		GroupBy:   groupBy,
+	}
+	if !from.IsZero() {
+		res.From = &from
+	}
+	if !to.IsZero() {
+		res.To = &to
+	}
+
+	total := make([]*repository.DelayBucketCount, len(delayHistogramBounds)+1)
+	groups := make(map[time.Time][]*repository.DelayBucketCount)
+	for _, count := range counts {
+		total[count.Bucket] = mergeDelayBucket(total[count.Bucket], count)
+		if period > 0 {
+			buckets, ok := groups[count.PeriodStart]
+			if !ok {
+				buckets = make([]*repository.DelayBucketCount, len(delayHistogramBounds)+1)
+				groups[count.PeriodStart] = buckets
+			}
+			buckets[count.Bucket] = count
+		}
+	}
+	res.DelayStats = *newDelayStats(total)
+	if res.Count == 0 {
+		return res, nil
+	}
+
+	groupStats := make(map[time.Time]*types.DelayStats, len(groups))
+	for start, buckets := range groups {
+		group := &types.DelayGroup{
+			Start:      start,
+			DelayStats: *newDelayStats(buckets),
+		}
+		groupStats[start] = &group.DelayStats
+		res.Groups = append(res.Groups, group)
+	}
+	sort.Slice(res.Groups, func(i, j int) bool {
+		return res.Groups[i].Start.Before(res.Groups[j].Start)
+	})
+
+	// percentiles of each group and of the whole window are ranked separately
+	percentiles, err := o.Repo.GetDelayPercentiles(filter, delayPercentiles)
+	if err != nil {
+		return nil, fmt.Errorf("get delay percentiles error: %v", err)
+	}
+	if period > 0 {
+		for _, percentile := range percentiles {
+			if stats, ok := groupStats[percentile.PeriodStart]; ok {
+				setPercentile(stats, percentile)
+			}
+		}
+		totalFilter := *filter
+		totalFilter.Period = 0
+		if percentiles, err = o.Repo.GetDelayPercentiles(&totalFilter, delayPercentiles); err != nil {
+			return nil, fmt.Errorf("get delay percentiles error: %v", err)
+		}
+	}
+	for _, percentile := range percentiles {
+		setPercentile(&res.DelayStats, percentile)
+	}
+	return res, nil
+}
+
+// merge count of the same bucket in another period into merged, merged is nil for the first one
+func mergeDelayBucket(merged, count *repository.DelayBucketCount) *repository.DelayBucketCount {
+	if merged == nil {
+		return &repository.DelayBucketCount{Bucket: count.Bucket, Count: count.Count, Sum: count.Sum, Max: count.Max}
+	}
+	merged.Count += count.Count
+	merged.Sum += count.Sum
+	merged.Max = math.Max(merged.Max, count.Max)
+	return merged
+}
+
+// statistics of delays in milliseconds by counts of each histogram bucket, nil for empty bucket,
+// percentiles are set by setPercentile
+func newDelayStats(buckets []*repository.DelayBucketCount) *types.DelayStats {
+	stats := &types.DelayStats{
+		Histogram: make([]*types.DelayBucket, 0, len(buckets)),
+	}
+	sum := 0.0
+	for i, bucket := range buckets {
+		histogramBucket := &types.DelayBucket{}
+		if i < len(delayHistogramBounds) {
+			histogramBucket.Le = &delayHistogramBounds[i]
+		}
+		if bucket != nil {
+			histogramBucket.Count = bucket.Count
+			stats.Count += bucket.Count
+			sum += bucket.Sum
+			stats.Max = math.Max(stats.Max, bucket.Max)
+		}
+		stats.Histogram = append(stats.Histogram, histogramBucket)
+	}
+	if stats.Count > 0 {
+		stats.Mean = sum / float64(stats.Count)
+	}
+	return stats
+}
+
+func setPercentile(stats *types.DelayStats, percentile *repository.DelayPercentile) {
+	switch percentile.Percentile {
+	case 50:
+		stats.P50 = percentile.Delay
+	case 90:
+		stats.P90 = percentile.Delay
+	case 99:
+		stats.P99 = percentile.Delay
+	}
+}
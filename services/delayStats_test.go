@@ -0,0 +1,87 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/averitas/courier_go/repository"
+	"github.com/averitas/courier_go/types"
+	"github.com/golang/mock/gomock"
+)
+
+func TestGetDelayStats(t *testing.T) {
+	mockCtrl = gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	setup()
+
+	// mock structs, delays are 10ms to 50ms in the first minute, 60ms to 100ms in the second one
+	from := time.Date(2022, 11, 20, 10, 0, 0, 0, time.UTC)
+	to := from.Add(2 * time.Minute)
+	counts := []*repository.DelayBucketCount{
+		{PeriodStart: from, Bucket: 0, Count: 5, Sum: 150, Max: 50},
+		{PeriodStart: from.Add(time.Minute), Bucket: 1, Count: 5, Sum: 400, Max: 100},
+	}
+	mockRepo.EXPECT().GetDelayHistogram(gomock.Any()).DoAndReturn(
+		func(f *repository.DelayFilter) ([]*repository.DelayBucketCount, error) {
+			if !f.FinishedFrom.Equal(from) || !f.FinishedTo.Equal(to) || f.Period != time.Minute || len(f.Bounds) != len(delayHistogramBounds) {
+				return nil, fmt.Errorf("unexpected filter %v", f)
+			}
+			return counts, nil
+		})
+	// percentiles of each minute, then of the whole window
+	mockRepo.EXPECT().GetDelayPercentiles(gomock.Any(), gomock.Eq(delayPercentiles)).Times(2).DoAndReturn(
+		func(f *repository.DelayFilter, percentiles []int) ([]*repository.DelayPercentile, error) {
+			if f.Period == 0 {
+				return []*repository.DelayPercentile{{Percentile: 50, Delay: 50}, {Percentile: 90, Delay: 90}, {Percentile: 99, Delay: 100}}, nil
+			}
+			return []*repository.DelayPercentile{
+				{PeriodStart: from, Percentile: 50, Delay: 30},
+				{PeriodStart: from, Percentile: 90, Delay: 50},
+				{PeriodStart: from, Percentile: 99, Delay: 50},
+				{PeriodStart: from.Add(time.Minute), Percentile: 50, Delay: 80},
+				{PeriodStart: from.Add(time.Minute), Percentile: 90, Delay: 100},
+				{PeriodStart: from.Add(time.Minute), Percentile: 99, Delay: 100},
+			}, nil
+		})
+
+	// begin test
+	stats, err := testService.GetDelayStats(types.OrderTypeFIFO, from, to, types.GroupByMinute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 10 || stats.Mean != 55 || stats.P50 != 50 || stats.P90 != 90 || stats.P99 != 100 || stats.Max != 100 {
+		t.Errorf("unexpected stats: %+v", stats.DelayStats)
+	}
+	if stats.From == nil || stats.To == nil {
+		t.Errorf("unexpected window from %v to %v", stats.From, stats.To)
+	}
+	if len(stats.Histogram) != len(delayHistogramBounds)+1 ||
+		stats.Histogram[0].Count != 5 || stats.Histogram[1].Count != 5 || stats.Histogram[len(delayHistogramBounds)].Le != nil {
+		t.Errorf("unexpected histogram: %v %v", stats.Histogram[0], stats.Histogram[1])
+	}
+	if len(stats.Groups) != 2 || !stats.Groups[0].Start.Equal(from) || stats.Groups[0].Count != 5 ||
+		stats.Groups[0].P50 != 30 || stats.Groups[1].Count != 5 || stats.Groups[1].Max != 100 || stats.Groups[1].P90 != 100 {
+		t.Errorf("unexpected groups: %v", stats.Groups)
+	}
+
+	// invalid groupBy, unbounded or too many groups
+	for _, query := range []struct {
+		from, to time.Time
+		groupBy  string
+	}{
+		{from, time.Time{}, "day"},
+		{time.Time{}, from, types.GroupByMinute},
+		{from, from.Add(2 * maxDelayGroups * time.Minute), types.GroupByMinute},
+		{from, from, ""},
+	} {
+		if _, err := testService.GetDelayStats(types.OrderTypeFIFO, query.from, query.to, query.groupBy); !errors.Is(err, ErrInvalidDelayQuery) {
+			t.Errorf("expected ErrInvalidDelayQuery of %v, got %v", query, err)
+		}
+	}
+
+	// Finished
+	tearDown()
+}
@@ -0,0 +1,240 @@
+package services
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/averitas/courier_go/types"
+)
+
+const (
+	DispatchRandom      = "random"
+	DispatchRoundRobin  = "roundrobin"
+	DispatchLeastLoaded = "leastloaded"
+	DispatchWeighted    = "weighted"
+)
+
+// Dispatcher choose which courier a "match" order will be sent to
+type Dispatcher interface {
+	// Pick one courier url from candidates for the order
+	Pick(candidates []string, order *types.Order) (string, error)
+	// Release tell dispatcher the order is no longer handled by courierUrl,
+	// e.g. calling courier api failed
+	Release(courierUrl string, order *types.Order)
+}
+
+// @description create dispatcher by strategy name,
+// high priority orders are always sent to the least loaded courier
+// @param strategy string one of random, roundrobin, leastloaded, weighted
+// @param capacity CapacityProvider capacity of each courier url, used by weighted dispatcher
+// @return Dispatcher
+// @return error
+func NewDispatcher(strategy string, capacity CapacityProvider) (Dispatcher, error) {
+	switch strategy {
+	case DispatchRandom, "":
+		return NewPriorityDispatcher(&RandomDispatcher{}), nil
+	case DispatchRoundRobin:
+		return NewPriorityDispatcher(&RoundRobinDispatcher{}), nil
+	case DispatchLeastLoaded:
+		return NewLeastLoadedDispatcher(), nil
+	case DispatchWeighted:
+		return NewPriorityDispatcher(NewWeightedDispatcher(capacity)), nil
+	default:
+		return nil, fmt.Errorf("dispatch strategy [%s] is invalid", strategy)
+	}
+}
+
+// send high priority orders to the least loaded courier and others by Normal.
+// Load of couriers counts orders sent by both.
+type PriorityDispatcher struct {
+	Normal      Dispatcher
+	leastLoaded *LeastLoadedDispatcher
+}
+
+func NewPriorityDispatcher(normal Dispatcher) *PriorityDispatcher {
+	return &PriorityDispatcher{
+		Normal:      normal,
+		leastLoaded: NewLeastLoadedDispatcher(),
+	}
+}
+
+func (d *PriorityDispatcher) Pick(candidates []string, order *types.Order) (string, error) {
+	if order.IsHighPriority() {
+		return d.leastLoaded.Pick(candidates, order)
+	}
+	target, err := d.Normal.Pick(candidates, order)
+	if err != nil {
+		return "", err
+	}
+	d.leastLoaded.track(target, order)
+	return target, nil
+}
+
+func (d *PriorityDispatcher) Release(courierUrl string, order *types.Order) {
+	d.leastLoaded.Release(courierUrl, order)
+	if !order.IsHighPriority() {
+		d.Normal.Release(courierUrl, order)
+	}
+}
+
+// CapacityProvider return capacity of courier, 0 if unknown
+type CapacityProvider interface {
+	Capacity(courierUrl string) int
+}
+
+// choose a random courier, this is the default behavior
+type RandomDispatcher struct {
+}
+
+func (d *RandomDispatcher) Pick(candidates []string, order *types.Order) (string, error) {
+	if len(candidates) < 1 {
+		return "", fmt.Errorf("please configure courier url first")
+	}
+	return candidates[rand.Intn(len(candidates))], nil
+}
+
+func (d *RandomDispatcher) Release(courierUrl string, order *types.Order) {
+}
+
+// choose couriers one by one
+type RoundRobinDispatcher struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (d *RoundRobinDispatcher) Pick(candidates []string, order *types.Order) (string, error) {
+	if len(candidates) < 1 {
+		return "", fmt.Errorf("please configure courier url first")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	target := candidates[d.next%len(candidates)]
+	d.next = (d.next + 1) % len(candidates)
+	return target, nil
+}
+
+func (d *RoundRobinDispatcher) Release(courierUrl string, order *types.Order) {
+}
+
+// choose the courier with least outstanding orders.
+// apiserver doesn't know when courier finish an order, so an order
+// is treated as outstanding until its PrepTime elapsed.
+type LeastLoadedDispatcher struct {
+	mu          sync.Mutex
+	outstanding map[string]map[string]time.Time
+
+	// used to mock time in tests
+	now func() time.Time
+}
+
+func NewLeastLoadedDispatcher() *LeastLoadedDispatcher {
+	return &LeastLoadedDispatcher{
+		outstanding: make(map[string]map[string]time.Time),
+		now:         time.Now,
+	}
+}
+
+func (d *LeastLoadedDispatcher) Pick(candidates []string, order *types.Order) (string, error) {
+	if len(candidates) < 1 {
+		return "", fmt.Errorf("please configure courier url first")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	target := candidates[0]
+	least := -1
+	for _, candidate := range candidates {
+		load := d.loadLocked(candidate)
+		if least < 0 || load < least {
+			target = candidate
+			least = load
+		}
+	}
+
+	d.trackLocked(target, order)
+	return target, nil
+}
+
+// count order as outstanding of courier picked by others
+func (d *LeastLoadedDispatcher) track(courierUrl string, order *types.Order) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.trackLocked(courierUrl, order)
+}
+
+func (d *LeastLoadedDispatcher) trackLocked(courierUrl string, order *types.Order) {
+	if d.outstanding[courierUrl] == nil {
+		d.outstanding[courierUrl] = make(map[string]time.Time)
+	}
+	d.outstanding[courierUrl][order.Id] = d.now().Add(time.Duration(order.PrepTime) * time.Second)
+}
+
+func (d *LeastLoadedDispatcher) Release(courierUrl string, order *types.Order) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.outstanding[courierUrl], order.Id)
+}
+
+// remove expired orders and return outstanding count, caller must hold mu
+func (d *LeastLoadedDispatcher) loadLocked(courierUrl string) int {
+	orders := d.outstanding[courierUrl]
+	now := d.now()
+	for id, deadline := range orders {
+		if !deadline.After(now) {
+			delete(orders, id)
+		}
+	}
+	return len(orders)
+}
+
+// choose couriers in proportion to their capacity with smooth weighted round robin,
+// courier without configured capacity has weight 1
+type WeightedDispatcher struct {
+	mu       sync.Mutex
+	capacity CapacityProvider
+	current  map[string]int
+}
+
+func NewWeightedDispatcher(capacity CapacityProvider) *WeightedDispatcher {
+	return &WeightedDispatcher{
+		capacity: capacity,
+		current:  make(map[string]int),
+	}
+}
+
+func (d *WeightedDispatcher) Pick(candidates []string, order *types.Order) (string, error) {
+	if len(candidates) < 1 {
+		return "", fmt.Errorf("please configure courier url first")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	total := 0
+	target := ""
+	for _, candidate := range candidates {
+		weight := d.weightLocked(candidate)
+		total += weight
+		d.current[candidate] += weight
+		if target == "" || d.current[candidate] > d.current[target] {
+			target = candidate
+		}
+	}
+	d.current[target] -= total
+	return target, nil
+}
+
+func (d *WeightedDispatcher) Release(courierUrl string, order *types.Order) {
+}
+
+func (d *WeightedDispatcher) weightLocked(courierUrl string) int {
+	if d.capacity == nil {
+		return 1
+	}
+	if weight := d.capacity.Capacity(courierUrl); weight > 0 {
+		return weight
+	}
+	return 1
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/averitas/courier_go/types"
+)
+
+var testCouriers = []string{"http://a.com", "http://b.com", "http://c.com"}
+
+func TestRoundRobinDispatcher(t *testing.T) {
+	dispatcher := &RoundRobinDispatcher{}
+	order := &types.Order{Id: "id123", PrepTime: 1}
+
+	for i := 0; i < 2*len(testCouriers); i++ {
+		target, err := dispatcher.Pick(testCouriers, order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != testCouriers[i%len(testCouriers)] {
+			t.Errorf("round %d picked %s, expected %s", i, target, testCouriers[i%len(testCouriers)])
+		}
+	}
+}
+
+func TestLeastLoadedDispatcher(t *testing.T) {
+	now := time.Now()
+	dispatcher := NewLeastLoadedDispatcher()
+	dispatcher.now = func() time.Time { return now }
+
+	// every courier get one order first
+	picked := make(map[string]bool)
+	for i := 0; i < len(testCouriers); i++ {
+		target, _ := dispatcher.Pick(testCouriers, &types.Order{Id: string(rune('a' + i)), PrepTime: 10 + i})
+		picked[target] = true
+	}
+	if len(picked) != len(testCouriers) {
+		t.Errorf("orders are not spread to all couriers: %v", picked)
+	}
+
+	// release order of courier b, then b is the least loaded one
+	dispatcher.Release(testCouriers[1], &types.Order{Id: "b"})
+	target, _ := dispatcher.Pick(testCouriers, &types.Order{Id: "d", PrepTime: 10})
+	if target != testCouriers[1] {
+		t.Errorf("picked %s, expected %s", target, testCouriers[1])
+	}
+
+	// order of courier a is cooked after 10 seconds
+	now = now.Add(10 * time.Second)
+	target, _ = dispatcher.Pick(testCouriers, &types.Order{Id: "e", PrepTime: 10})
+	if target != testCouriers[0] {
+		t.Errorf("picked %s, expected %s", target, testCouriers[0])
+	}
+}
+
+func TestPriorityDispatcher(t *testing.T) {
+	dispatcher := NewPriorityDispatcher(&RoundRobinDispatcher{})
+
+	// normal orders go to a and b by round robin
+	for i, id := range []string{"a", "b"} {
+		target, _ := dispatcher.Pick(testCouriers, &types.Order{Id: id, PrepTime: 10})
+		if target != testCouriers[i] {
+			t.Errorf("picked %s, expected %s", target, testCouriers[i])
+		}
+	}
+
+	// high priority order goes to c which has no order
+	target, _ := dispatcher.Pick(testCouriers, &types.Order{Id: "c", PrepTime: 10, Priority: types.HighPriority})
+	if target != testCouriers[2] {
+		t.Errorf("picked %s, expected %s", target, testCouriers[2])
+	}
+}
+
+func TestWeightedDispatcher(t *testing.T) {
+	dispatcher := NewWeightedDispatcher(NewCourierRegistry(testCouriers, map[string]int{
+		testCouriers[0]: 3,
+		testCouriers[1]: 1,
+	}, time.Second))
+	order := &types.Order{Id: "id123", PrepTime: 1}
+
+	count := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		target, err := dispatcher.Pick(testCouriers, order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count[target]++
+	}
+	if count[testCouriers[0]] != 30 || count[testCouriers[1]] != 10 || count[testCouriers[2]] != 10 {
+		t.Errorf("orders are not dispatched by capacity: %v", count)
+	}
+}
+
+func TestNewDispatcher(t *testing.T) {
+	if _, err := NewDispatcher("unknown", nil); err == nil {
+		t.Errorf("expected error of unknown strategy")
+	}
+	if _, err := (&RandomDispatcher{}).Pick(nil, &types.Order{}); err == nil {
+		t.Errorf("expected error when no courier configured")
+	}
+}
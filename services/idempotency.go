@@ -0,0 +1,111 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/averitas/courier_go/models"
+	"github.com/averitas/courier_go/repository"
+	"github.com/averitas/courier_go/tools/logger"
+)
+
+var (
+	ErrIdempotencyKeyInProgress = fmt.Errorf("request with same Idempotency-Key is in progress")
+	ErrIdempotencyKeyReused     = fmt.Errorf("Idempotency-Key was used by a different request")
+)
+
+// IdempotencyService remember responses of requests sent with Idempotency-Key header,
+// so a retried request gets the same response without being processed again.
+// Records older than TTL are expired and the key could be used again.
+type IdempotencyService struct {
+	Repo repository.IIdempotencyRepo
+	TTL  time.Duration
+}
+
+// @description Start processing request with key
+// @param key string Idempotency-Key header
+// @param request []byte content identifying the request, e.g. method, path and body
+// @return *models.IdempotencyRecord finished record to replay, nil if request should be processed
+// @return error ErrIdempotencyKeyInProgress, ErrIdempotencyKeyReused or database error
+func (s *IdempotencyService) Begin(key string, request []byte) (*models.IdempotencyRecord, error) {
+	sum := sha256.Sum256(request)
+	hash := hex.EncodeToString(sum[:])
+
+	err := s.Repo.CreateRecord(&models.IdempotencyRecord{Key: key, RequestHash: hash})
+	if err == nil {
+		return nil, nil
+	} else if !errors.Is(err, repository.ErrIdempotencyKeyExists) {
+		return nil, fmt.Errorf("save idempotency key error: %v", err)
+	}
+
+	existing, err := s.Repo.GetRecord(key)
+	if errors.Is(err, repository.ErrOrderNotFound) {
+		// the other request with this key failed and removed it just now
+		return nil, ErrIdempotencyKeyInProgress
+	} else if err != nil {
+		return nil, fmt.Errorf("get idempotency key error: %v", err)
+	}
+
+	if time.Since(existing.CreatedAt) > s.TTL {
+		if err := s.Repo.DeleteRecord(key); err != nil {
+			return nil, fmt.Errorf("delete expired idempotency key error: %v", err)
+		}
+		err = s.Repo.CreateRecord(&models.IdempotencyRecord{Key: key, RequestHash: hash})
+		if errors.Is(err, repository.ErrIdempotencyKeyExists) {
+			return nil, ErrIdempotencyKeyInProgress
+		} else if err != nil {
+			return nil, fmt.Errorf("save idempotency key error: %v", err)
+		}
+		return nil, nil
+	}
+
+	if existing.RequestHash != hash {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if existing.StatusCode == 0 {
+		return nil, ErrIdempotencyKeyInProgress
+	}
+	return existing, nil
+}
+
+// @description Remember response of request started by Begin
+// @param key string Idempotency-Key header
+// @param statusCode int
+// @param response []byte
+// @return error
+func (s *IdempotencyService) Finish(key string, statusCode int, response []byte) error {
+	return s.Repo.UpdateRecord(&models.IdempotencyRecord{
+		Key:        key,
+		StatusCode: statusCode,
+		Response:   string(response),
+	})
+}
+
+// @description Forget request started by Begin, so it could be retried with same key
+// @param key string Idempotency-Key header
+func (s *IdempotencyService) Abort(key string) {
+	if err := s.Repo.DeleteRecord(key); err != nil {
+		logger.ErrorLogger.Printf("delete idempotency key [%s] error: %v\n", key, err)
+	}
+}
+
+// StartCleaner delete expired records periodically until ctx is done
+func (s *IdempotencyService) StartCleaner(ctx context.Context) {
+	ticker := time.NewTicker(s.TTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.InfoLogger.Println("background idempotency key cleaner stopped")
+			return
+		case <-ticker.C:
+			if err := s.Repo.DeleteRecordsBefore(time.Now().Add(-s.TTL)); err != nil {
+				logger.ErrorLogger.Printf("delete expired idempotency keys error: %v\n", err)
+			}
+		}
+	}
+}
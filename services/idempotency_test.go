@@ -0,0 +1,69 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/averitas/courier_go/mocks"
+	"github.com/averitas/courier_go/models"
+	"github.com/averitas/courier_go/repository"
+	"github.com/golang/mock/gomock"
+)
+
+func TestIdempotencyBegin(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	repo := mocks.NewMockIIdempotencyRepo(ctrl)
+	service := &IdempotencyService{Repo: repo, TTL: time.Hour}
+	request := []byte("POST /api/sendOrder/fifo\n[]")
+
+	// first request is processed
+	repo.EXPECT().CreateRecord(gomock.Any()).Return(nil)
+	record, err := service.Begin("key", request)
+	if err != nil || record != nil {
+		t.Fatalf("expected request processed, got %v %v", record, err)
+	}
+
+	var saved *models.IdempotencyRecord
+	repo.EXPECT().UpdateRecord(gomock.Any()).DoAndReturn(func(r *models.IdempotencyRecord) error {
+		saved = r
+		return nil
+	})
+	if err := service.Finish("key", 202, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	// same request is replayed
+	existing := &models.IdempotencyRecord{
+		Key:         "key",
+		RequestHash: "",
+		StatusCode:  saved.StatusCode,
+		Response:    saved.Response,
+		CreatedAt:   time.Now(),
+	}
+	repo.EXPECT().CreateRecord(gomock.Any()).DoAndReturn(func(r *models.IdempotencyRecord) error {
+		existing.RequestHash = r.RequestHash
+		return repository.ErrIdempotencyKeyExists
+	})
+	repo.EXPECT().GetRecord("key").Return(existing, nil)
+	record, err = service.Begin("key", request)
+	if err != nil || record != existing {
+		t.Errorf("expected response replayed, got %v %v", record, err)
+	}
+
+	// different request with same key is rejected
+	repo.EXPECT().CreateRecord(gomock.Any()).Return(repository.ErrIdempotencyKeyExists)
+	repo.EXPECT().GetRecord("key").Return(existing, nil)
+	if _, err = service.Begin("key", []byte("other")); err != ErrIdempotencyKeyReused {
+		t.Errorf("expected key reused error, got %v", err)
+	}
+
+	// request still processing
+	existing.StatusCode = 0
+	repo.EXPECT().CreateRecord(gomock.Any()).Return(repository.ErrIdempotencyKeyExists)
+	repo.EXPECT().GetRecord("key").Return(existing, nil)
+	if _, err = service.Begin("key", request); err != ErrIdempotencyKeyInProgress {
+		t.Errorf("expected key in progress error, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// how long a cancellation is remembered for an order not cooked by this worker yet
+const cancelRetention = 10 * time.Minute
+
+// result of Kitchen.Start
+type KitchenResult int
+
+const (
+	// order started cooking
+	KitchenStarted KitchenResult = iota
+	// order was cancelled before cooking started
+	KitchenCancelled
+	// order is already cooking or waiting for a slot in this kitchen,
+	// e.g. its message is delivered again after connection to queue dropped
+	KitchenInFlight
+	// ctx is done before a slot is free
+	KitchenStopped
+)
+
+// Kitchen track orders being cooked by this worker, so they could be cancelled.
+// Orders are identified by OrderModel.Id, an order is cooked once at a time.
+// At most concurrency orders are cooked at once, others wait for a free slot.
+type Kitchen struct {
+	mu      sync.Mutex
+	cooking map[string]context.CancelFunc
+	// orders cooking or waiting for a slot
+	inFlight map[string]struct{}
+	// orders cancelled before cooking started
+	cancelled map[string]time.Time
+	// semaphore of cooking orders, nil if unlimited
+	slots chan struct{}
+}
+
+// @description create kitchen
+// @param concurrency int max orders cooked at once, unlimited if less than 1
+// @return *Kitchen
+func NewKitchen(concurrency int) *Kitchen {
+	k := &Kitchen{
+		cooking:   make(map[string]context.CancelFunc),
+		inFlight:  make(map[string]struct{}),
+		cancelled: make(map[string]time.Time),
+	}
+	if concurrency > 0 {
+		k.slots = make(chan struct{}, concurrency)
+	}
+	return k
+}
+
+// @description start cooking order after a slot is free, the returned context is done when order is cancelled
+// @param ctx context.Context
+// @param id string OrderModel.Id
+// @return context.Context cancelled when Cancel(id) is called
+// @return func() must be called when cooking finished
+// @return KitchenResult KitchenStarted if order started cooking, otherwise why it's not started
+func (k *Kitchen) Start(ctx context.Context, id string) (context.Context, func(), KitchenResult) {
+	k.mu.Lock()
+	if _, ok := k.inFlight[id]; ok {
+		k.mu.Unlock()
+		return ctx, func() {}, KitchenInFlight
+	}
+	k.inFlight[id] = struct{}{}
+	k.mu.Unlock()
+
+	release := func() {}
+	if k.slots != nil {
+		select {
+		case k.slots <- struct{}{}:
+			release = func() { <-k.slots }
+		case <-ctx.Done():
+			k.mu.Lock()
+			delete(k.inFlight, id)
+			k.mu.Unlock()
+			return ctx, func() {}, KitchenStopped
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.cancelled[id]; ok {
+		delete(k.cancelled, id)
+		delete(k.inFlight, id)
+		release()
+		return ctx, func() {}, KitchenCancelled
+	}
+
+	cookCtx, cancel := context.WithCancel(ctx)
+	k.cooking[id] = cancel
+	return cookCtx, func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		delete(k.cooking, id)
+		delete(k.inFlight, id)
+		cancel()
+		release()
+	}, KitchenStarted
+}
+
+// @description cancel order if it's cooking, otherwise remember it
+// so order is not cooked when it arrives later
+// @param id string OrderModel.Id
+// @return bool true if order is cooking in this kitchen
+func (k *Kitchen) Cancel(id string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if cancel, ok := k.cooking[id]; ok {
+		cancel()
+		delete(k.cooking, id)
+		return true
+	}
+
+	now := time.Now()
+	for cancelledId, at := range k.cancelled {
+		if now.Sub(at) > cancelRetention {
+			delete(k.cancelled, cancelledId)
+		}
+	}
+	k.cancelled[id] = now
+	return false
+}
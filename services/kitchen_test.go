@@ -0,0 +1,65 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestKitchenConcurrency(t *testing.T) {
+	kitchen := NewKitchen(1)
+
+	_, doneA, result := kitchen.Start(context.Background(), "a")
+	if result != KitchenStarted {
+		t.Fatal("first order should start cooking")
+	}
+
+	// no free slot until first order is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, result := kitchen.Start(ctx, "b"); result != KitchenStopped {
+		t.Fatal("second order should wait for a free slot")
+	}
+
+	doneA()
+	_, doneB, result := kitchen.Start(context.Background(), "b")
+	if result != KitchenStarted {
+		t.Fatal("second order should start after first is done")
+	}
+	doneB()
+
+	// cancelled order doesn't take the slot
+	kitchen.Cancel("c")
+	if _, _, result := kitchen.Start(context.Background(), "c"); result != KitchenCancelled {
+		t.Fatal("cancelled order should not start")
+	}
+	if _, done, result := kitchen.Start(context.Background(), "d"); result != KitchenStarted {
+		t.Fatal("slot of cancelled order should be released")
+	} else {
+		done()
+	}
+}
+
+func TestKitchenInFlight(t *testing.T) {
+	kitchen := NewKitchen(2)
+
+	cookCtx, done, result := kitchen.Start(context.Background(), "a")
+	if result != KitchenStarted {
+		t.Fatal("first delivery should start cooking")
+	}
+	// same order delivered again doesn't cook twice or take over cancellation
+	if _, _, result := kitchen.Start(context.Background(), "a"); result != KitchenInFlight {
+		t.Fatalf("second delivery should be in flight, got %v", result)
+	}
+	if !kitchen.Cancel("a") || cookCtx.Err() == nil {
+		t.Fatal("cancellation should reach the first delivery")
+	}
+	done()
+
+	// cooked again after done
+	if _, done, result := kitchen.Start(context.Background(), "a"); result != KitchenStarted {
+		t.Fatalf("order should start cooking after done, got %v", result)
+	} else {
+		done()
+	}
+}
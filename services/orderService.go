@@ -2,10 +2,11 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"path"
@@ -24,24 +25,155 @@ type OrderService struct {
 	Repo         repository.IOrderRepo
 	HttpClient   tools.HttpClient
 	CouriersUrl  []string
+	// strategy to choose courier of "match" order, random if not set
+	Dispatcher Dispatcher
+	// alive couriers registered by workers, CouriersUrl is used if not set
+	Registry *CourierRegistry
+	// broadcast cancellation of fifo orders to workers
+	CancelQueueManager tools.IQueueManager
+	// orders cooking by this worker
+	Kitchen *Kitchen
+	// recorded in order status history as who made the transition
+	Actor string
+	// id of worker recorded on orders it's cooking, so they're resumed after restart
+	Owner string
+	// outbox messages are written with orders if set, so relay dispatches orders
+	// not dispatched by request, e.g. apiserver crashed before dispatching
+	Outbox repository.IOutboxRepo
+	// outbox message is left for the request saving it in this duration before relay picks it
+	OutboxGrace time.Duration
 }
 
-// @description Save order to database with given order struct
+// default of OrderService.OutboxGrace
+const defaultOutboxGrace = 30 * time.Second
+
+// @description Save order to database with given order struct.
+// Order with same id is saved only once, the existing order is returned if it's submitted again.
 // @param order *types.Order order received from api
+// @return *models.OrderModel saved model or existing model with same id
+// @return bool false if order with same id exists, it shouldn't be dispatched again
 // @return error
-func (o *OrderService) SaveOrder(order *types.Order) error {
+func (o *OrderService) SaveOrder(order *types.Order) (*models.OrderModel, bool, error) {
 	orderModel := &models.OrderModel{
 		Id:          order.Id,
 		PrepTime:    order.PrepTime,
+		Priority:    order.Priority,
+		ScheduledAt: order.ScheduledAt,
 		Name:        order.Name,
 		OrderStatus: models.OrderStarted,
 		OrderType:   order.OrderType,
 	}
-	err := o.Repo.CreateOrder(orderModel)
+	outbox, err := o.newOutboxMessage(order, orderModel.DispatchAt())
 	if err != nil {
-		return fmt.Errorf("save order error: %v", err)
+		return nil, false, err
 	}
-	return nil
+	err = o.Repo.CreateOrder(orderModel, outbox)
+	if errors.Is(err, repository.ErrOrderExists) {
+		existing, err := o.Repo.GetOrderById(order.Id)
+		if err != nil {
+			return nil, false, fmt.Errorf("get existing order error: %v", err)
+		}
+		logger.InfoLogger.Printf("Order with id [%s] exists as [%s], skip it\n", order.Id, existing.OrderId)
+		return existing, false, nil
+	} else if errors.Is(err, repository.ErrOrderIdConflict) {
+		logger.ErrorLogger.Printf("order [%s] not saved: %v, is -nodeId of apiservers unique?\n", order.Id, err)
+		return nil, false, fmt.Errorf("save order error: %v", err)
+	} else if err != nil {
+		return nil, false, fmt.Errorf("save order error: %v", err)
+	}
+	return orderModel, true, nil
+}
+
+// outbox message of order, scheduled order is dispatched by relay at dispatchAt
+func (o *OrderService) newOutboxMessage(order *types.Order, dispatchAt time.Time) (*models.OutboxMessage, error) {
+	if o.Outbox == nil {
+		if order.ScheduledAt != nil {
+			return nil, fmt.Errorf("scheduled order isn't supported without outbox")
+		}
+		return nil, nil
+	}
+	payload, err := json.Marshal(order)
+	if err != nil {
+		return nil, fmt.Errorf("marshal outbox message error: %v", err)
+	}
+	grace := o.OutboxGrace
+	if grace <= 0 {
+		grace = defaultOutboxGrace
+	}
+	nextAttemptAt := time.Now().Add(grace)
+	if dispatchAt.After(time.Now()) {
+		nextAttemptAt = dispatchAt
+	}
+	return &models.OutboxMessage{
+		Kind:          order.OrderType,
+		Payload:       string(payload),
+		Status:        models.OutboxPending,
+		NextAttemptAt: nextAttemptAt,
+	}, nil
+}
+
+// @description Check if order is scheduled and should be dispatched later by outbox relay
+// @param model *models.OrderModel
+// @return bool
+func (o *OrderService) IsScheduled(model *models.OrderModel) bool {
+	return model.DispatchAt().After(time.Now())
+}
+
+// @description Move order failed to dispatch back to dispatched, so request submitting it
+// again dispatches it. Its outbox message is pending again, in case request doesn't finish
+// dispatching. Orders failed after a worker started cooking them aren't retried.
+// @param model *models.OrderModel failed order
+// @return bool false if order can't be retried
+// @return error *models.InvalidTransitionError if order isn't failed any more
+func (o *OrderService) RetryDispatch(model *models.OrderModel) (bool, error) {
+	if len(model.CookingOwner) > 0 {
+		return false, nil
+	}
+	if err := o.TransitionOrder(model, models.OrderDispatched); err != nil {
+		return false, err
+	}
+	if o.Outbox == nil {
+		return true, nil
+	}
+	grace := o.OutboxGrace
+	if grace <= 0 {
+		grace = defaultOutboxGrace
+	}
+	nextAttemptAt := time.Now().Add(grace)
+	if dispatchAt := model.DispatchAt(); dispatchAt.After(time.Now()) {
+		nextAttemptAt = dispatchAt
+	}
+	if err := o.Outbox.ReopenOutbox(model.OrderId, nextAttemptAt); err != nil {
+		// order is dispatched by request, only crash safety is lost
+		logger.ErrorLogger.Printf("reopen outbox message of order [%s] error: %v\n", model.OrderId, err)
+	}
+	return true, nil
+}
+
+// @description Close outbox message of order after request dispatched it or gave up,
+// so relay won't publish it again
+// @param model *models.OrderModel
+// @param delivered bool false if order couldn't be dispatched
+func (o *OrderService) CloseOutbox(model *models.OrderModel, delivered bool) {
+	if o.Outbox == nil {
+		return
+	}
+	status := models.OutboxDelivered
+	if !delivered {
+		status = models.OutboxDiscarded
+	}
+	if err := o.Outbox.CloseOutbox(model.OrderId, status); err != nil {
+		// relay will dispatch it again, it's fine since dispatch is at least once
+		logger.ErrorLogger.Printf("close outbox message of order [%s] error: %v\n", model.OrderId, err)
+	}
+}
+
+// @description Move order to status and record it in status history
+// @param model *models.OrderModel
+// @param to models.OrderStatus
+// @return error *models.InvalidTransitionError if transition is illegal
+func (o *OrderService) TransitionOrder(model *models.OrderModel, to models.OrderStatus) error {
+	return o.Repo.TransitionStatus(model, to, o.Actor)
 }
 
 // @description Get the single latest order with 'id' in order struct
@@ -52,31 +184,189 @@ func (o *OrderService) GetOrderModel(order *types.Order) (res *models.OrderModel
 	return
 }
 
+// @description Get order detail with client supplied order id
+// @param id string OrderModel.Id
+// @return *types.OrderDetail
+// @return error repository.ErrOrderNotFound if order doesn't exist
+func (o *OrderService) GetOrderDetail(id string) (*types.OrderDetail, error) {
+	model, err := o.Repo.GetOrderById(id)
+	if err != nil {
+		return nil, err
+	}
+	history, err := o.Repo.GetStatusHistory(model.OrderId)
+	if err != nil {
+		return nil, fmt.Errorf("get order status history error: %v", err)
+	}
+
+	var finishedAt time.Time
+	for _, h := range history {
+		if h.ToStatus == models.OrderFinished {
+			finishedAt = h.CreatedAt
+		}
+	}
+	detail := newOrderDetail(model, finishedAt)
+	detail.History = make([]*types.OrderPhase, 0, len(history))
+	for i, h := range history {
+		phase := &types.OrderPhase{
+			Status: h.ToStatus.String(),
+			At:     h.CreatedAt,
+			Actor:  h.Actor,
+		}
+		if i > 0 {
+			phase.Duration = float64(h.CreatedAt.Sub(history[i-1].CreatedAt)) / float64(time.Millisecond)
+		}
+		detail.History = append(detail.History, phase)
+	}
+	return detail, nil
+}
+
+// @description List a page of orders matching filter
+// @param filter *repository.OrderFilter
+// @return *types.OrderList
+// @return error
+func (o *OrderService) ListOrders(filter *repository.OrderFilter) (*types.OrderList, error) {
+	limit := filter.Limit
+	if limit < 1 {
+		return nil, fmt.Errorf("limit %d is invalid", limit)
+	}
+
+	// query one more order to know if there is next page
+	query := *filter
+	query.Limit = limit + 1
+	orderModels, err := o.Repo.ListOrders(&query)
+	if err != nil {
+		return nil, fmt.Errorf("list orders error: %v", err)
+	}
+
+	res := &types.OrderList{
+		Orders: make([]*types.OrderDetail, 0, len(orderModels)),
+	}
+	if len(orderModels) > limit {
+		orderModels = orderModels[:limit]
+		res.NextCursor = orderModels[limit-1].OrderId
+	}
+	for _, model := range orderModels {
+		// history isn't loaded for list, finish time is only known by order still finished,
+		// which is updated by its last transition
+		var finishedAt time.Time
+		if model.OrderStatus == models.OrderFinished {
+			finishedAt = model.UpdatedAt
+		}
+		res.Orders = append(res.Orders, newOrderDetail(model, finishedAt))
+	}
+	return res, nil
+}
+
+// pickup delay is set if finishedAt isn't zero
+func newOrderDetail(model *models.OrderModel, finishedAt time.Time) *types.OrderDetail {
+	detail := &types.OrderDetail{
+		OrderId:     model.OrderId,
+		Id:          model.Id,
+		Name:        model.Name,
+		OrderType:   model.OrderType,
+		Status:      model.OrderStatus.String(),
+		PrepTime:    model.PrepTime,
+		Priority:    model.Priority,
+		ScheduledAt: model.ScheduledAt,
+		CreatedAt:   model.CreatedAt,
+		UpdatedAt:   model.UpdatedAt,
+	}
+	if !finishedAt.IsZero() {
+		delay := float64(model.PickupDelay(finishedAt)) / float64(time.Millisecond)
+		detail.PickupDelay = &delay
+	}
+	return detail
+}
+
 // @description This function simulate courier wait kitchen cooking and
-// finish this order. It will wait PrepTime seconds, then set status to finished
+// finish this order. It will wait PrepTime seconds, then set status to finished.
+// Cooking deadline and Owner are saved with cooking status, an order already cooking
+// by Owner is resumed until its deadline, unless it's cooking in Kitchen by another delivery
+// of its message. If order is cancelled in Kitchen, it stops
+// waiting and set status to cancelled. If ctx is done, order is left cooking,
+// or tools.ErrRequeue is returned if it's done before cooking started.
+// @param ctx context.Context
 // @param model *models.OrderModel model retrieved from database
 // @return error
-func (o *OrderService) WaitUntilOrderCooked(model *models.OrderModel) (err error) {
+func (o *OrderService) WaitUntilOrderCooked(ctx context.Context, model *models.OrderModel) (err error) {
 	defer func() {
 		if rcy := recover(); rcy != nil {
 			err = fmt.Errorf("handler error: %v\n!panic: %v", err, rcy)
 		}
 	}()
 
-	// set order status to cooking
-	model.OrderStatus = models.OrderCooking
-	err = o.Repo.SaveModel(model)
-	if err != nil {
-		return fmt.Errorf("order set status to cooking err: %v", err)
+	if model.OrderStatus.IsTerminal() || model.OrderStatus == models.OrderFinished || model.OrderStatus == models.OrderPickedUp {
+		logger.InfoLogger.Printf("Order [%s] is %v, skip cooking\n", model.OrderId, model.OrderStatus)
+		return nil
+	}
+	// order message delivered again, it's resumed by its owner or taken over by others
+	if model.OrderStatus == models.OrderCooking && model.CookingOwner != o.Owner {
+		logger.InfoLogger.Printf("Order [%s] is cooking by [%s], skip cooking\n", model.OrderId, model.CookingOwner)
+		return nil
+	}
+
+	// ctx is done when worker stopping, cookCtx is also done when order cancelled
+	cookCtx := ctx
+	if o.Kitchen != nil {
+		var done func()
+		var result KitchenResult
+		cookCtx, done, result = o.Kitchen.Start(ctx, model.Id)
+		defer done()
+		switch {
+		case ctx.Err() != nil:
+			// not a failed delivery, order message is requeued at its position
+			// and cooked by next worker, order stays as it is
+			return fmt.Errorf("%w: worker stopped before cooking order [%s]", tools.ErrRequeue, model.OrderId)
+		case result == KitchenInFlight:
+			// message delivered again while the first delivery is cooking it,
+			// which finishes the order
+			logger.InfoLogger.Printf("Order [%s] is already cooking in this worker, skip cooking\n", model.OrderId)
+			return nil
+		case result == KitchenCancelled:
+			return o.cancelCooking(model)
+		}
+	}
+
+	if model.OrderStatus != models.OrderCooking {
+		// courier arrived at kitchen
+		if model.OrderStatus == models.OrderDispatched {
+			err = o.TransitionOrder(model, models.OrderCourierArrived)
+			if err != nil {
+				return fmt.Errorf("order set status to courier arrived err: %v", err)
+			}
+		}
+
+		// set order status to cooking with deadline, so it's resumed if worker restarted
+		deadline := time.Now().Add(time.Duration(model.PrepTime) * time.Second)
+		err = o.Repo.StartCooking(model, o.Owner, deadline, o.Actor)
+		if err != nil {
+			return fmt.Errorf("order set status to cooking err: %v", err)
+		}
+		logger.InfoLogger.Printf("Order [%s] started cooking\n", model.OrderId)
+	} else {
+		logger.InfoLogger.Printf("Order [%s] resumed cooking\n", model.OrderId)
 	}
-	logger.InfoLogger.Printf("Order [%s] started cooking\n", model.OrderId)
 
 	// wait order
-	time.Sleep(time.Duration(model.PrepTime) * time.Second)
+	var wait time.Duration
+	if model.CookingDeadline != nil {
+		wait = time.Until(*model.CookingDeadline)
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-cookCtx.Done():
+		if ctx.Err() != nil {
+			// keep order cooking, it's resumed after worker restarted
+			logger.InfoLogger.Printf("Worker stopped, order [%s] is resumed after restart\n", model.OrderId)
+			return nil
+		}
+		return o.cancelCooking(model)
+	case <-timer.C:
+	}
 
 	// order is done, move status to finished
-	model.OrderStatus = models.OrderFinished
-	err = o.Repo.SaveModel(model)
+	err = o.TransitionOrder(model, models.OrderFinished)
 	if err != nil {
 		return fmt.Errorf("order set status to finished err: %v", err)
 	}
@@ -84,6 +374,113 @@ func (o *OrderService) WaitUntilOrderCooked(model *models.OrderModel) (err error
 	return nil
 }
 
+func (o *OrderService) cancelCooking(model *models.OrderModel) error {
+	err := o.TransitionOrder(model, models.OrderCancelled)
+	var invalid *models.InvalidTransitionError
+	if errors.As(err, &invalid) && invalid.From == models.OrderCancelled {
+		// apiserver already recorded the cancellation
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("order set status to cancelled err: %v", err)
+	}
+	logger.InfoLogger.Printf("Order [%s] cancelled!\n", model.OrderId)
+	return nil
+}
+
+// @description Courier picked up finished order with client supplied order id,
+// move it to picked up. Picking up a picked up order does nothing.
+// @param id string OrderModel.Id
+// @return error repository.ErrOrderNotFound if order doesn't exist,
+// *models.InvalidTransitionError if order isn't finished
+func (o *OrderService) PickUpOrder(id string) error {
+	return o.advanceOrder(id, models.OrderPickedUp)
+}
+
+// @description Courier delivered picked up order with client supplied order id,
+// move it to delivered. Delivering a delivered order does nothing.
+// @param id string OrderModel.Id
+// @return error repository.ErrOrderNotFound if order doesn't exist,
+// *models.InvalidTransitionError if order isn't picked up
+func (o *OrderService) DeliverOrder(id string) error {
+	return o.advanceOrder(id, models.OrderDelivered)
+}
+
+// move order to status reported by courier, retried reports are ignored
+func (o *OrderService) advanceOrder(id string, to models.OrderStatus) error {
+	model, err := o.Repo.GetOrderById(id)
+	if err != nil {
+		return err
+	}
+	if model.OrderStatus == to {
+		return nil
+	}
+	return o.TransitionOrder(model, to)
+}
+
+// @description Cancel order with client supplied order id. Order is set to cancelled
+// in database, then the cancellation is sent to couriers: by calling courier api
+// for "match" orders, or by CancelQueueManager for "fifo" orders.
+// Cancelling a cancelled order does nothing.
+// @param id string OrderModel.Id
+// @return error repository.ErrOrderNotFound if order doesn't exist,
+// *models.InvalidTransitionError if order can't be cancelled, e.g. finished
+func (o *OrderService) CancelOrder(id string) error {
+	model, err := o.Repo.GetOrderById(id)
+	if err != nil {
+		return err
+	}
+	if model.OrderStatus == models.OrderCancelled {
+		return nil
+	}
+
+	err = o.TransitionOrder(model, models.OrderCancelled)
+	if err != nil {
+		return err
+	}
+
+	message := &types.CancelOrder{Id: id}
+	if model.OrderType == types.OrderTypeFIFO {
+		if o.CancelQueueManager == nil {
+			return fmt.Errorf("cancel queue is not configured")
+		}
+		if err := o.CancelQueueManager.Send(message); err != nil {
+			return fmt.Errorf("send cancel message error: %v", err)
+		}
+		return nil
+	}
+
+	// courier of match order is unknown, send to all of them
+	for _, courier := range o.courierCandidates() {
+		if err := o.callCourierCancelAPI(courier, message); err != nil {
+			logger.WarningLogger.Printf("cancel order [%s] on courier [%s] error: %v\n", id, courier, err)
+		}
+	}
+	return nil
+}
+
+func (o *OrderService) callCourierCancelAPI(courierUrl string, message *types.CancelOrder) error {
+	targetUrl, err := url.Parse(courierUrl)
+	if err != nil {
+		return fmt.Errorf("configured url %v is invalid", courierUrl)
+	}
+	targetUrl.Path = path.Join(targetUrl.Path, "api", "orders", message.Id, "cancel")
+
+	req, err := http.NewRequest(http.MethodPost, targetUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := o.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(res)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("call courier cancel api got status: %v", res.StatusCode)
+	}
+	return nil
+}
+
 // @description This function send order message to queue
 // @param order *types.Order order received from api
 // @return error
@@ -96,43 +493,120 @@ func (o *OrderService) SendOrderMessage(order *types.Order) error {
 }
 
 // @description This function send order message to courier
-// by call courier API directly. It will choose a random courier
-// to send message
+// by call courier API directly. It will choose a courier by
+// configured Dispatcher to send message. If the courier is unavailable,
+// it is reported to Registry and the order is sent to another courier.
 // @param order *types.Order order received from api
 // @return error
 func (o *OrderService) CallRandomCourierAPI(order *types.Order) error {
-	if len(o.CouriersUrl) < 1 {
+	dispatcher := o.getDispatcher()
+	candidates := o.courierCandidates()
+	if len(candidates) < 1 {
 		return fmt.Errorf("please configure courier url first")
 	}
 
-	urlIndex := rand.Intn(len(o.CouriersUrl))
-	targetUrl, err := url.Parse(o.CouriersUrl[urlIndex])
+	var lastErr error
+	for len(candidates) > 0 {
+		courierUrl, err := dispatcher.Pick(candidates, order)
+		if err != nil {
+			return err
+		}
+
+		statusCode, err := o.callCourierAPI(courierUrl, order)
+		if err == nil {
+			o.reportCourierSuccess(courierUrl)
+			return nil
+		}
+		dispatcher.Release(courierUrl, order)
+
+		// courier rejected this order, other couriers will reject it as well
+		if statusCode > 0 && statusCode < http.StatusInternalServerError {
+			return err
+		}
+
+		logger.WarningLogger.Printf("courier [%s] unavailable, try another one: %v\n", courierUrl, err)
+		o.reportCourierFailure(courierUrl)
+		lastErr = err
+		candidates = removeCandidate(candidates, courierUrl)
+	}
+	return fmt.Errorf("all couriers unavailable, last error: %v", lastErr)
+}
+
+func removeCandidate(candidates []string, courierUrl string) []string {
+	res := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate != courierUrl {
+			res = append(res, candidate)
+		}
+	}
+	return res
+}
+
+func (o *OrderService) reportCourierSuccess(courierUrl string) {
+	if o.Registry != nil {
+		o.Registry.ReportSuccess(courierUrl)
+	}
+}
+
+func (o *OrderService) reportCourierFailure(courierUrl string) {
+	if o.Registry != nil {
+		o.Registry.ReportFailure(courierUrl)
+	}
+}
+
+func (o *OrderService) getDispatcher() Dispatcher {
+	if o.Dispatcher == nil {
+		return &RandomDispatcher{}
+	}
+	return o.Dispatcher
+}
+
+func (o *OrderService) courierCandidates() []string {
+	if o.Registry == nil {
+		return o.CouriersUrl
+	}
+	return o.Registry.List()
+}
+
+// call courier api, return status code of response, 0 if no response received
+func (o *OrderService) callCourierAPI(courierUrl string, order *types.Order) (int, error) {
+	targetUrl, err := url.Parse(courierUrl)
 	if err != nil {
-		return fmt.Errorf("configured url %v is invalid", o.CouriersUrl[urlIndex])
+		return 0, fmt.Errorf("configured url %v is invalid", courierUrl)
 	}
 	targetUrl.Path = path.Join(targetUrl.Path, "api", "sendOrder")
 
 	orderMessage, err := json.Marshal(order)
 	if err != nil {
-		return fmt.Errorf("err when SendOrderMessage marshal order error: %v", err)
+		return 0, fmt.Errorf("err when SendOrderMessage marshal order error: %v", err)
 	}
 	req, err := http.NewRequest(http.MethodPost, targetUrl.String(), bytes.NewReader(orderMessage))
 	if err != nil {
-		return fmt.Errorf("err when SendOrderMessage generate http request to url [%s] error: %v", targetUrl.String(), err)
+		return 0, fmt.Errorf("err when SendOrderMessage generate http request to url [%s] error: %v", targetUrl.String(), err)
 	}
 
 	res, err := o.HttpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("err when SendOrderMessage call url [%s] error: %v", targetUrl.String(), err)
+		return 0, fmt.Errorf("err when SendOrderMessage call url [%s] error: %v", targetUrl.String(), err)
 	}
+	defer closeBody(res)
 
 	if res.StatusCode >= 300 {
 		buf := new(strings.Builder)
 		io.Copy(buf, res.Body)
-		return fmt.Errorf("call courier api got status: %v error: %s", res.StatusCode, buf.String())
+		return res.StatusCode, fmt.Errorf("call courier api got status: %v error: %s", res.StatusCode, buf.String())
 	}
 
-	return nil
+	return res.StatusCode, nil
+}
+
+// drain and close body of response, so its connection is reused and its timeout released
+func closeBody(res *http.Response) {
+	if res.Body == nil {
+		return
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
 }
 
 // return average delay value in seconds of requested orderType
@@ -142,3 +616,27 @@ func (o *OrderService) CallRandomCourierAPI(order *types.Order) error {
 func (o *OrderService) GetAverageDelayOfType(orderType string) (float32, error) {
 	return o.Repo.GetAverageDelayOfOrderType(orderType)
 }
+
+// @description get average time orders of order type stayed in each status
+// @param orderType string
+// @return map[string]float32 average seconds by status name
+// @return error
+func (o *OrderService) GetAverageDelayByPhase(orderType string) (map[string]float32, error) {
+	byStatus, err := o.Repo.GetAveragePhaseDelay(orderType)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]float32, len(byStatus))
+	for status, delay := range byStatus {
+		res[status.String()] = delay
+	}
+	return res, nil
+}
+
+// @description get average delay of each priority of order type
+// @param orderType string
+// @return map[int]float32 average delay in seconds by priority
+// @return error
+func (o *OrderService) GetAverageDelayByPriority(orderType string) (map[int]float32, error) {
+	return o.Repo.GetAverageDelayByPriority(orderType)
+}
@@ -1,7 +1,9 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,6 +14,8 @@ import (
 
 	"github.com/averitas/courier_go/mocks"
 	"github.com/averitas/courier_go/models"
+	"github.com/averitas/courier_go/repository"
+	"github.com/averitas/courier_go/tools"
 	"github.com/averitas/courier_go/types"
 	"github.com/golang/mock/gomock"
 )
@@ -62,7 +66,7 @@ func TestCreateOrder(t *testing.T) {
 
 	// set mock controller
 	gomock.InOrder(
-		mockRepo.EXPECT().CreateOrder(gomock.Any()).Return(nil),
+		mockRepo.EXPECT().CreateOrder(gomock.Any(), gomock.Any()).Return(nil),
 	)
 
 	// begin test
@@ -72,6 +76,74 @@ func TestCreateOrder(t *testing.T) {
 	tearDown()
 }
 
+func TestSaveDuplicateOrder(t *testing.T) {
+	mockCtrl = gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	setup()
+
+	order := &types.Order{
+		Id:       "id123",
+		Name:     "n123",
+		PrepTime: 1,
+	}
+	existing := &models.OrderModel{
+		OrderId:     "ORDER000000001",
+		Id:          order.Id,
+		OrderStatus: models.OrderCooking,
+	}
+
+	gomock.InOrder(
+		mockRepo.EXPECT().CreateOrder(gomock.Any(), gomock.Any()).Return(repository.ErrOrderExists),
+		mockRepo.EXPECT().GetOrderById(order.Id).Return(existing, nil),
+	)
+
+	model, created, err := testService.SaveOrder(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created || model != existing {
+		t.Errorf("expected existing order returned, got %v created %v", model, created)
+	}
+
+	tearDown()
+}
+
+func TestSaveScheduledOrder(t *testing.T) {
+	mockCtrl = gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	setup()
+	testService.Outbox = mocks.NewMockIOutboxRepo(mockCtrl)
+
+	scheduledAt := time.Now().Add(time.Hour)
+	order := &types.Order{
+		Id:          "id123",
+		Name:        "n123",
+		PrepTime:    60,
+		ScheduledAt: &scheduledAt,
+	}
+
+	// outbox message is relayed when it's time to cook
+	mockRepo.EXPECT().CreateOrder(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(model *models.OrderModel, outbox *models.OutboxMessage) error {
+			if !outbox.NextAttemptAt.Equal(scheduledAt.Add(-time.Minute)) {
+				t.Errorf("expected outbox message relayed at %v, got %v", scheduledAt.Add(-time.Minute), outbox.NextAttemptAt)
+			}
+			return nil
+		})
+
+	model, created, err := testService.SaveOrder(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || !testService.IsScheduled(model) {
+		t.Errorf("expected scheduled order created, got %v created %v", model, created)
+	}
+
+	tearDown()
+}
+
 func TestCallRandomCourierAPI(t *testing.T) {
 	mockCtrl = gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -100,10 +172,10 @@ func TestCallRandomCourierAPI(t *testing.T) {
 				buf := new(strings.Builder)
 				io.Copy(buf, req.Body)
 				if buf.String() != string(orderMessage) {
-					return &http.Response{StatusCode: http.StatusBadRequest}, nil
+					return &http.Response{StatusCode: http.StatusBadRequest, Body: http.NoBody}, nil
 				}
 
-				return &http.Response{StatusCode: http.StatusOK}, nil
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
 			},
 		),
 	)
@@ -118,6 +190,54 @@ func TestCallRandomCourierAPI(t *testing.T) {
 	tearDown()
 }
 
+func TestCallRandomCourierAPIFailover(t *testing.T) {
+	mockCtrl = gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	setup()
+
+	// mock structs
+	order := &types.Order{
+		Id:       "id123",
+		Name:     "n123",
+		PrepTime: 1,
+	}
+	testService.Registry = NewCourierRegistry([]string{"http://down.com", "http://up.com"}, nil, time.Second)
+	testService.Dispatcher = &RoundRobinDispatcher{}
+
+	// set mock controller
+	gomock.InOrder(
+		mockHttpClient.EXPECT().Do(gomock.Any()).DoAndReturn(
+			func(req *http.Request) (*http.Response, error) {
+				if req.URL.Host != "down.com" {
+					return nil, fmt.Errorf("should call down.com first, got %s", req.URL.Host)
+				}
+				return nil, fmt.Errorf("connection refused")
+			},
+		),
+		mockHttpClient.EXPECT().Do(gomock.Any()).DoAndReturn(
+			func(req *http.Request) (*http.Response, error) {
+				if req.URL.Host != "up.com" {
+					return nil, fmt.Errorf("should fail over to up.com, got %s", req.URL.Host)
+				}
+				return &http.Response{StatusCode: http.StatusAccepted, Body: http.NoBody}, nil
+			},
+		),
+	)
+
+	// begin test
+	err := testService.CallRandomCourierAPI(order)
+	if err != nil {
+		t.Error(err)
+	}
+	if couriers := testService.Registry.List(); len(couriers) != 1 || couriers[0] != "http://up.com" {
+		t.Errorf("down courier should be unhealthy, healthy couriers: %v", couriers)
+	}
+
+	// Finished
+	tearDown()
+}
+
 func TestWaitUntilOrderCooked(t *testing.T) {
 	mockCtrl = gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -146,7 +266,7 @@ func TestWaitUntilOrderCooked(t *testing.T) {
 		&models.OrderModel{
 			OrderId:     "testid",
 			OrderType:   "fifo",
-			OrderStatus: models.OrderStarted,
+			OrderStatus: models.OrderDispatched,
 			Id:          order.Id,
 			Name:        order.Name,
 			PrepTime:    order.PrepTime,
@@ -154,29 +274,14 @@ func TestWaitUntilOrderCooked(t *testing.T) {
 			UpdatedAt:   orderModel.UpdatedAt,
 		}, nil)
 	gomock.InOrder(
-		mockRepo.EXPECT().SaveModel(gomock.Any()).DoAndReturn(
-			func(m *models.OrderModel) error {
-				if m.OrderStatus != models.OrderCooking {
-					return fmt.Errorf("Didn't start cooking status")
-				}
-
-				orderModel.UpdatedAt = time.Now()
-				orderModel.OrderStatus = m.OrderStatus
-
-				return nil
-			},
+		mockRepo.EXPECT().TransitionStatus(gomock.Any(), gomock.Eq(models.OrderCourierArrived), gomock.Any()).DoAndReturn(
+			mockTransition(orderModel),
 		),
-		mockRepo.EXPECT().SaveModel(gomock.Any()).DoAndReturn(
-			func(m *models.OrderModel) error {
-				if m.OrderStatus != models.OrderFinished {
-					return fmt.Errorf("Didn't set finished status")
-				}
-
-				orderModel.UpdatedAt = time.Now()
-				orderModel.OrderStatus = m.OrderStatus
-
-				return nil
-			},
+		mockRepo.EXPECT().StartCooking(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			mockStartCooking(orderModel),
+		),
+		mockRepo.EXPECT().TransitionStatus(gomock.Any(), gomock.Eq(models.OrderFinished), gomock.Any()).DoAndReturn(
+			mockTransition(orderModel),
 		),
 	)
 
@@ -186,7 +291,7 @@ func TestWaitUntilOrderCooked(t *testing.T) {
 	go func() {
 		model1, _ := testService.GetOrderModel(order)
 
-		var err = testService.WaitUntilOrderCooked(model1)
+		var err = testService.WaitUntilOrderCooked(context.Background(), model1)
 		if err != nil {
 			t.Error(err)
 		}
@@ -203,6 +308,316 @@ func TestWaitUntilOrderCooked(t *testing.T) {
 	tearDown()
 }
 
+func TestWaitUntilOrderCookedCancelled(t *testing.T) {
+	mockCtrl = gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	setup()
+	testService.Kitchen = NewKitchen(0)
+
+	// mock structs
+	orderModel := &models.OrderModel{
+		OrderId:     "testid",
+		OrderType:   "match",
+		OrderStatus: models.OrderStarted,
+		Id:          "id123",
+		PrepTime:    10,
+	}
+	cooking := make(chan interface{})
+	gomock.InOrder(
+		mockRepo.EXPECT().StartCooking(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(m *models.OrderModel, owner string, deadline time.Time, actor string) error {
+				close(cooking)
+				m.CookingDeadline = &deadline
+				return m.Transition(models.OrderCooking)
+			},
+		),
+		// apiserver cancelled the order before worker
+		mockRepo.EXPECT().TransitionStatus(gomock.Any(), gomock.Eq(models.OrderCancelled), gomock.Any()).Return(
+			&models.InvalidTransitionError{From: models.OrderCancelled, To: models.OrderCancelled},
+		),
+	)
+
+	// begin test
+	start := time.Now()
+	go func() {
+		<-cooking
+		if !testService.Kitchen.Cancel(orderModel.Id) {
+			t.Errorf("order should be cooking")
+		}
+	}()
+	err := testService.WaitUntilOrderCooked(context.Background(), orderModel)
+	if err != nil {
+		t.Error(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("cooking didn't stop after cancelled")
+	}
+
+	// order cancelled before cooking is not cooked
+	testService.Kitchen.Cancel("id456")
+	mockRepo.EXPECT().TransitionStatus(gomock.Any(), gomock.Eq(models.OrderCancelled), gomock.Any()).Return(nil)
+	err = testService.WaitUntilOrderCooked(context.Background(), &models.OrderModel{
+		Id:          "id456",
+		OrderStatus: models.OrderDispatched,
+		PrepTime:    10,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Finished
+	tearDown()
+}
+
+func TestWaitUntilOrderCookedWorkerStopped(t *testing.T) {
+	mockCtrl = gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	setup()
+	testService.Kitchen = NewKitchen(0)
+	testService.Owner = "worker:8081"
+
+	// mock structs
+	orderModel := &models.OrderModel{
+		OrderId:     "testid",
+		OrderType:   "fifo",
+		OrderStatus: models.OrderDispatched,
+		Id:          "id123",
+		PrepTime:    10,
+	}
+	cooking := make(chan interface{})
+	gomock.InOrder(
+		mockRepo.EXPECT().TransitionStatus(gomock.Any(), gomock.Eq(models.OrderCourierArrived), gomock.Any()).DoAndReturn(
+			mockTransition(orderModel),
+		),
+		mockRepo.EXPECT().StartCooking(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(m *models.OrderModel, owner string, deadline time.Time, actor string) error {
+				defer close(cooking)
+				return mockStartCooking(orderModel)(m, owner, deadline, actor)
+			},
+		),
+	)
+
+	// begin test, worker stops while cooking
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-cooking
+		cancel()
+	}()
+	start := time.Now()
+	err := testService.WaitUntilOrderCooked(ctx, orderModel)
+	if err != nil {
+		t.Error(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("cooking didn't stop after worker stopped")
+	}
+	// order is left cooking by this worker to be resumed after restart
+	if orderModel.OrderStatus != models.OrderCooking || orderModel.CookingOwner != testService.Owner {
+		t.Errorf("order should be cooking by %s, got %v by %s", testService.Owner, orderModel.OrderStatus, orderModel.CookingOwner)
+	}
+	if orderModel.CookingDeadline == nil || orderModel.CookingDeadline.Before(start.Add(9*time.Second)) {
+		t.Errorf("cooking deadline should be kept, got %v", orderModel.CookingDeadline)
+	}
+
+	// Finished
+	tearDown()
+}
+
+func TestWaitUntilOrderCookedStoppedBeforeCooking(t *testing.T) {
+	mockCtrl = gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	setup()
+	testService.Kitchen = NewKitchen(1)
+
+	// the only slot is taken, order waits for it until worker stops
+	_, done, _ := testService.Kitchen.Start(context.Background(), "other")
+	defer done()
+	orderModel := &models.OrderModel{
+		OrderId:     "testid",
+		OrderType:   "fifo",
+		OrderStatus: models.OrderDispatched,
+		Id:          "id123",
+		PrepTime:    1,
+	}
+
+	// begin test, message is requeued without touching order
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := testService.WaitUntilOrderCooked(ctx, orderModel)
+	if !errors.Is(err, tools.ErrRequeue) {
+		t.Errorf("expected ErrRequeue, got %v", err)
+	}
+	if orderModel.OrderStatus != models.OrderDispatched {
+		t.Errorf("order should stay dispatched, got %v", orderModel.OrderStatus)
+	}
+
+	// Finished
+	tearDown()
+}
+
+func TestWaitUntilOrderCookedDeliveredTwice(t *testing.T) {
+	mockCtrl = gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	setup()
+	testService.Kitchen = NewKitchen(0)
+	testService.Owner = "worker:8081"
+
+	// order cooking by this worker, its message delivered again after connection dropped
+	deadline := time.Now().Add(300 * time.Millisecond)
+	newModel := func() *models.OrderModel {
+		return &models.OrderModel{
+			OrderId:         "testid",
+			OrderType:       "fifo",
+			OrderStatus:     models.OrderCooking,
+			Id:              "id123",
+			PrepTime:        1,
+			CookingOwner:    testService.Owner,
+			CookingDeadline: &deadline,
+		}
+	}
+	mockRepo.EXPECT().TransitionStatus(gomock.Any(), gomock.Eq(models.OrderFinished), gomock.Any()).Times(1).DoAndReturn(
+		mockTransition(newModel()),
+	)
+
+	// begin test, both deliveries succeed and order is finished once
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- testService.WaitUntilOrderCooked(context.Background(), newModel())
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Finished
+	tearDown()
+}
+
+func TestGetOrderDetail(t *testing.T) {
+	mockCtrl = gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	setup()
+
+	// mock structs
+	createdAt := time.Now()
+	mockRepo.EXPECT().GetOrderById(gomock.Eq("id123")).Return(
+		&models.OrderModel{
+			OrderId:     "ORDER000000001",
+			OrderType:   types.OrderTypeMatch,
+			OrderStatus: models.OrderPickedUp,
+			Id:          "id123",
+			Name:        "n123",
+			PrepTime:    3,
+			CreatedAt:   createdAt,
+			UpdatedAt:   createdAt.Add(10 * time.Second),
+		}, nil)
+
+	// pickup delay ends when order is finished, not at later pickup
+	mockRepo.EXPECT().GetStatusHistory(gomock.Eq("ORDER000000001")).Return(
+		[]*models.OrderStatusHistory{
+			{ToStatus: models.OrderStarted, CreatedAt: createdAt},
+			{FromStatus: models.OrderStarted, ToStatus: models.OrderDispatched, CreatedAt: createdAt.Add(20 * time.Millisecond)},
+			{FromStatus: models.OrderDispatched, ToStatus: models.OrderCooking, CreatedAt: createdAt.Add(50 * time.Millisecond)},
+			{FromStatus: models.OrderCooking, ToStatus: models.OrderFinished, CreatedAt: createdAt.Add(3*time.Second + 150*time.Millisecond)},
+			{FromStatus: models.OrderFinished, ToStatus: models.OrderPickedUp, CreatedAt: createdAt.Add(10 * time.Second)},
+		}, nil)
+
+	// begin test
+	detail, err := testService.GetOrderDetail("id123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.OrderId != "ORDER000000001" || detail.Status != "picked_up" {
+		t.Errorf("unexpected order detail: %v", detail)
+	}
+	if detail.PickupDelay == nil || *detail.PickupDelay != 150 {
+		t.Errorf("pickup delay should be 150ms, got %v", detail.PickupDelay)
+	}
+	if len(detail.History) != 5 || detail.History[1].Status != "dispatched" || detail.History[1].Duration != 20 {
+		t.Errorf("unexpected order history: %v", detail.History)
+	}
+
+	// Finished
+	tearDown()
+}
+
+func TestListOrders(t *testing.T) {
+	mockCtrl = gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	setup()
+
+	// mock structs
+	filter := &repository.OrderFilter{
+		OrderType: types.OrderTypeFIFO,
+		Cursor:    "ORDER000000001",
+		Limit:     2,
+	}
+	mockRepo.EXPECT().ListOrders(gomock.Any()).DoAndReturn(
+		func(f *repository.OrderFilter) ([]*models.OrderModel, error) {
+			if f.Limit != 3 || f.Cursor != filter.Cursor || f.OrderType != filter.OrderType {
+				return nil, fmt.Errorf("unexpected filter %v", f)
+			}
+			return []*models.OrderModel{
+				{OrderId: "ORDER000000002", OrderStatus: models.OrderStarted},
+				{OrderId: "ORDER000000003", OrderStatus: models.OrderCooking},
+				{OrderId: "ORDER000000004", OrderStatus: models.OrderStarted},
+			}, nil
+		})
+	mockRepo.EXPECT().ListOrders(gomock.Any()).Return([]*models.OrderModel{
+		{OrderId: "ORDER000000004", OrderStatus: models.OrderStarted},
+	}, nil)
+
+	// begin test
+	page, err := testService.ListOrders(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Orders) != 2 || page.NextCursor != "ORDER000000003" {
+		t.Errorf("unexpected first page: %v, next cursor %s", page.Orders, page.NextCursor)
+	}
+
+	filter.Cursor = page.NextCursor
+	page, err = testService.ListOrders(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Orders) != 1 || page.NextCursor != "" {
+		t.Errorf("unexpected last page: %v, next cursor %s", page.Orders, page.NextCursor)
+	}
+
+	// Finished
+	tearDown()
+}
+
+// mock repo TransitionStatus, record status and time to orderModel
+func mockTransition(orderModel *models.OrderModel) func(*models.OrderModel, models.OrderStatus, string) error {
+	return func(m *models.OrderModel, to models.OrderStatus, actor string) error {
+		if err := m.Transition(to); err != nil {
+			return err
+		}
+		orderModel.UpdatedAt = time.Now()
+		orderModel.OrderStatus = m.OrderStatus
+		return nil
+	}
+}
+
+func mockStartCooking(orderModel *models.OrderModel) func(*models.OrderModel, string, time.Time, string) error {
+	return func(m *models.OrderModel, owner string, deadline time.Time, actor string) error {
+		m.CookingOwner = owner
+		m.CookingDeadline = &deadline
+		return mockTransition(orderModel)(m, models.OrderCooking, actor)
+	}
+}
+
 func setup() {
 	mockRepo = mocks.NewMockIOrderRepo(mockCtrl)
 	mockHttpClient = mocks.NewMockHttpClient(mockCtrl)
@@ -222,3 +637,70 @@ func tearDown() {
 	mockQueueManager = nil
 	mockRepo = nil
 }
+
+func TestPickUpAndDeliverOrder(t *testing.T) {
+	mockCtrl = gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	setup()
+
+	// mock structs
+	orderModel := &models.OrderModel{OrderId: "ORDER000000001", Id: "id123", OrderStatus: models.OrderFinished}
+	mockRepo.EXPECT().GetOrderById(gomock.Eq("id123")).Return(orderModel, nil).Times(4)
+	mockRepo.EXPECT().TransitionStatus(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(mockTransition(orderModel)).Times(3)
+
+	// begin test, retried reports are ignored
+	for i := 0; i < 2; i++ {
+		if err := testService.PickUpOrder("id123"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if orderModel.OrderStatus != models.OrderPickedUp {
+		t.Errorf("order should be picked up, got %v", orderModel.OrderStatus)
+	}
+	if err := testService.DeliverOrder("id123"); err != nil {
+		t.Fatal(err)
+	}
+	var invalid *models.InvalidTransitionError
+	if err := testService.PickUpOrder("id123"); !errors.As(err, &invalid) {
+		t.Errorf("expected invalid transition of delivered order, got %v", err)
+	}
+	if orderModel.OrderStatus != models.OrderDelivered {
+		t.Errorf("order should be delivered, got %v", orderModel.OrderStatus)
+	}
+
+	// Finished
+	tearDown()
+}
+
+func TestRetryDispatch(t *testing.T) {
+	mockCtrl = gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	setup()
+	mockOutbox := mocks.NewMockIOutboxRepo(mockCtrl)
+	testService.Outbox = mockOutbox
+
+	// mock structs
+	orderModel := &models.OrderModel{OrderId: "ORDER000000001", Id: "id123", OrderStatus: models.OrderFailed}
+	mockRepo.EXPECT().TransitionStatus(gomock.Any(), gomock.Eq(models.OrderDispatched), gomock.Any()).DoAndReturn(mockTransition(orderModel))
+	mockOutbox.EXPECT().ReopenOutbox(gomock.Eq("ORDER000000001"), gomock.Any()).Return(nil)
+
+	// begin test
+	retried, err := testService.RetryDispatch(orderModel)
+	if err != nil || !retried {
+		t.Fatalf("failed order should be retried, got %v %v", retried, err)
+	}
+	if orderModel.OrderStatus != models.OrderDispatched {
+		t.Errorf("order should be dispatched, got %v", orderModel.OrderStatus)
+	}
+
+	// order failed while cooking isn't retried
+	cooked := &models.OrderModel{OrderId: "ORDER000000002", OrderStatus: models.OrderFailed, CookingOwner: "worker:8081"}
+	if retried, err := testService.RetryDispatch(cooked); err != nil || retried {
+		t.Errorf("order failed while cooking shouldn't be retried, got %v %v", retried, err)
+	}
+
+	// Finished
+	tearDown()
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/averitas/courier_go/models"
+	"github.com/averitas/courier_go/repository"
+	"github.com/averitas/courier_go/tools/logger"
+	"github.com/averitas/courier_go/types"
+)
+
+// OutboxRelay dispatch orders of pending outbox messages, which are left by requests
+// that didn't finish dispatching. Orders are sent to queue or couriers at least once,
+// failed messages are retried with exponential backoff until MaxAttempts,
+// then the order is failed.
+type OutboxRelay struct {
+	Repo         repository.IOutboxRepo
+	OrderService *OrderService
+	Interval     time.Duration
+	BatchSize    int
+	MaxAttempts  int
+}
+
+// @description relay pending outbox messages periodically until ctx is done
+// @param ctx context.Context
+func (r *OutboxRelay) Start(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.InfoLogger.Println("background outbox relay stopped")
+			return
+		case <-ticker.C:
+			if err := r.RelayOnce(); err != nil {
+				logger.ErrorLogger.Printf("relay outbox error: %v\n", err)
+			}
+		}
+	}
+}
+
+// @description dispatch a batch of pending outbox messages
+// @return error
+func (r *OutboxRelay) RelayOnce() error {
+	messages, err := r.Repo.ListPendingOutbox(time.Now(), r.BatchSize)
+	if err != nil {
+		return fmt.Errorf("list pending outbox error: %v", err)
+	}
+	for _, msg := range messages {
+		// delay next attempt until this one surely finished, in case relay crashed
+		claimed, err := r.Repo.ClaimOutbox(msg, time.Now().Add(r.backoff(msg.Attempts+1)))
+		if err != nil {
+			return fmt.Errorf("claim outbox message %d error: %v", msg.ID, err)
+		}
+		if !claimed {
+			continue
+		}
+
+		err = r.relay(msg)
+		if err == nil {
+			msg.Status = models.OutboxDelivered
+			msg.LastError = ""
+		} else if msg.Attempts >= r.MaxAttempts {
+			logger.ErrorLogger.Printf("relay order [%s] failed %d times, give up: %v\n", msg.OrderId, msg.Attempts, err)
+			msg.Status = models.OutboxDiscarded
+			msg.LastError = err.Error()
+		} else {
+			logger.WarningLogger.Printf("relay order [%s] error, retry later: %v\n", msg.OrderId, err)
+			msg.LastError = err.Error()
+		}
+		if err := r.Repo.UpdateOutbox(msg); err != nil {
+			logger.ErrorLogger.Printf("update outbox message %d error: %v\n", msg.ID, err)
+		}
+	}
+	return nil
+}
+
+// dispatch order of message, order is failed if it's the last attempt
+func (r *OutboxRelay) relay(msg *models.OutboxMessage) error {
+	order := &types.Order{}
+	if err := json.Unmarshal([]byte(msg.Payload), order); err != nil {
+		return fmt.Errorf("unmarshal outbox message error: %v", err)
+	}
+	model, err := r.OrderService.GetOrderModel(order)
+	if err != nil {
+		return fmt.Errorf("get order error: %v", err)
+	}
+
+	switch model.OrderStatus {
+	case models.OrderStarted:
+		err = r.OrderService.TransitionOrder(model, models.OrderDispatched)
+		var invalid *models.InvalidTransitionError
+		if errors.As(err, &invalid) {
+			// dispatched or cancelled by others just now
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("set order status error: %v", err)
+		}
+	case models.OrderDispatched:
+		// request crashed after setting status, dispatch again
+	default:
+		// already handled by worker, or cancelled
+		return nil
+	}
+
+	logger.InfoLogger.Printf("relay order [%s] of outbox\n", model.OrderId)
+	if msg.Kind == types.OrderTypeFIFO {
+		err = r.OrderService.SendOrderMessage(order)
+	} else {
+		err = r.OrderService.CallRandomCourierAPI(order)
+	}
+	if err != nil && msg.Attempts >= r.MaxAttempts {
+		if terr := r.OrderService.TransitionOrder(model, models.OrderFailed); terr != nil {
+			logger.ErrorLogger.Printf("set order [%s] status to failed error: %v\n", model.OrderId, terr)
+		}
+	}
+	return err
+}
+
+// delay before attempt n, doubled every attempt and at most 5 minutes
+func (r *OutboxRelay) backoff(attempt int) time.Duration {
+	delay := r.Interval
+	for i := 1; i < attempt && delay < 5*time.Minute; i++ {
+		delay *= 2
+	}
+	if delay > 5*time.Minute {
+		delay = 5 * time.Minute
+	}
+	return delay
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/averitas/courier_go/mocks"
+	"github.com/averitas/courier_go/models"
+	"github.com/averitas/courier_go/types"
+	"github.com/golang/mock/gomock"
+)
+
+func TestOutboxRelay(t *testing.T) {
+	mockCtrl = gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	setup()
+	outboxRepo := mocks.NewMockIOutboxRepo(mockCtrl)
+	relay := &OutboxRelay{
+		Repo:         outboxRepo,
+		OrderService: testService,
+		Interval:     time.Second,
+		BatchSize:    10,
+		MaxAttempts:  2,
+	}
+
+	// mock structs
+	order := &types.Order{
+		Id:        "id123",
+		Name:      "n123",
+		PrepTime:  1,
+		OrderType: types.OrderTypeFIFO,
+	}
+	payload, _ := json.Marshal(order)
+	msg := &models.OutboxMessage{
+		ID:      1,
+		OrderId: "ORDER000000001",
+		Kind:    types.OrderTypeFIFO,
+		Payload: string(payload),
+	}
+	orderModel := &models.OrderModel{
+		OrderId:     msg.OrderId,
+		Id:          order.Id,
+		OrderStatus: models.OrderStarted,
+	}
+
+	// first attempt fails and is retried, second attempt is delivered
+	gomock.InOrder(
+		outboxRepo.EXPECT().ListPendingOutbox(gomock.Any(), 10).Return([]*models.OutboxMessage{msg}, nil),
+		outboxRepo.EXPECT().ClaimOutbox(msg, gomock.Any()).DoAndReturn(mockClaim),
+		mockRepo.EXPECT().GetOrderById(order.Id).Return(orderModel, nil),
+		mockRepo.EXPECT().TransitionStatus(orderModel, models.OrderDispatched, gomock.Any()).DoAndReturn(mockTransition(orderModel)),
+		mockQueueManager.EXPECT().Send(gomock.Any()).Return(fmt.Errorf("broker down")),
+		outboxRepo.EXPECT().UpdateOutbox(msg).DoAndReturn(func(m *models.OutboxMessage) error {
+			if m.Status != models.OutboxPending || len(m.LastError) == 0 {
+				t.Errorf("failed message should be retried, got %v", m)
+			}
+			return nil
+		}),
+
+		outboxRepo.EXPECT().ListPendingOutbox(gomock.Any(), 10).Return([]*models.OutboxMessage{msg}, nil),
+		outboxRepo.EXPECT().ClaimOutbox(msg, gomock.Any()).DoAndReturn(mockClaim),
+		mockRepo.EXPECT().GetOrderById(order.Id).Return(orderModel, nil),
+		mockQueueManager.EXPECT().Send(gomock.Any()).Return(nil),
+		outboxRepo.EXPECT().UpdateOutbox(msg).DoAndReturn(func(m *models.OutboxMessage) error {
+			if m.Status != models.OutboxDelivered {
+				t.Errorf("message should be delivered, got %v", m)
+			}
+			return nil
+		}),
+	)
+
+	// begin test
+	for i := 0; i < 2; i++ {
+		if err := relay.RelayOnce(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msg.Attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", msg.Attempts)
+	}
+
+	// Finished
+	tearDown()
+}
+
+func mockClaim(msg *models.OutboxMessage, until time.Time) (bool, error) {
+	msg.Attempts++
+	msg.NextAttemptAt = until
+	return true, nil
+}
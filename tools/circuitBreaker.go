@@ -0,0 +1,135 @@
+package tools
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	// requests pass through
+	BreakerClosed BreakerState = iota
+	// requests are rejected until OpenDuration passed
+	BreakerOpen
+	// one trial request is allowed, breaker is closed if it succeed
+	BreakerHalfOpen
+)
+
+var ErrCircuitOpen = fmt.Errorf("circuit breaker is open")
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// breaker status returned by admin api
+type BreakerStatus struct {
+	Target   string       `json:"target"`
+	State    BreakerState `json:"state"`
+	Failures int          `json:"failures"`
+	OpenedAt time.Time    `json:"openedAt"`
+}
+
+// CircuitBreaker open after FailureThreshold consecutive failures,
+// reject requests for OpenDuration, then allow one trial request
+type CircuitBreaker struct {
+	FailureThreshold int
+	OpenDuration     time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// a trial request is running in half-open state
+	trial bool
+
+	// used to mock time in tests
+	now func() time.Time
+}
+
+func NewCircuitBreaker(failureThreshold int, openDuration time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		FailureThreshold: failureThreshold,
+		OpenDuration:     openDuration,
+		state:            BreakerClosed,
+		now:              time.Now,
+	}
+}
+
+// Allow return ErrCircuitOpen if request should not be sent
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.OpenDuration {
+			return ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+		b.trial = true
+		return nil
+	case BreakerHalfOpen:
+		if b.trial {
+			return ErrCircuitOpen
+		}
+		b.trial = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Success record a successful request and close breaker
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.trial = false
+}
+
+// Failure record a failed request, open breaker if trial request
+// failed or failures reach FailureThreshold
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.state == BreakerHalfOpen || b.failures >= b.FailureThreshold {
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+func (b *CircuitBreaker) Status(target string) BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.state
+	if state == BreakerOpen && b.now().Sub(b.openedAt) >= b.OpenDuration {
+		state = BreakerHalfOpen
+	}
+	return BreakerStatus{
+		Target:   target,
+		State:    state,
+		Failures: b.failures,
+		OpenedAt: b.openedAt,
+	}
+}
@@ -0,0 +1,48 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := NewCircuitBreaker(2, 10*time.Second)
+	breaker.now = func() time.Time { return now }
+
+	// open after 2 failures
+	for i := 0; i < 2; i++ {
+		if err := breaker.Allow(); err != nil {
+			t.Fatalf("closed breaker rejected request: %v", err)
+		}
+		breaker.Failure()
+	}
+	if err := breaker.Allow(); err != ErrCircuitOpen {
+		t.Errorf("expected open breaker, got %v", err)
+	}
+
+	// only one trial request after open duration
+	now = now.Add(10 * time.Second)
+	if err := breaker.Allow(); err != nil {
+		t.Errorf("expected trial request allowed, got %v", err)
+	}
+	if err := breaker.Allow(); err != ErrCircuitOpen {
+		t.Errorf("expected only one trial request, got %v", err)
+	}
+
+	// failed trial open breaker again
+	breaker.Failure()
+	if status := breaker.Status("t"); status.State != BreakerOpen {
+		t.Errorf("expected open breaker, got %v", status.State)
+	}
+
+	// succeed trial close breaker
+	now = now.Add(10 * time.Second)
+	if err := breaker.Allow(); err != nil {
+		t.Errorf("expected trial request allowed, got %v", err)
+	}
+	breaker.Success()
+	if status := breaker.Status("t"); status.State != BreakerClosed || status.Failures != 0 {
+		t.Errorf("expected closed breaker, got %v", status)
+	}
+}
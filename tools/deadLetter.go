@@ -0,0 +1,197 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/averitas/courier_go/tools/logger"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// headers of redelivered and dead lettered messages
+const (
+	retryCountHeader    = "x-retry-count"
+	originalQueueHeader = "x-original-queue"
+	errorHeader         = "x-error"
+)
+
+// handler returns error wrapping ErrRequeue to put message back to queue as it is,
+// it's not a failed delivery, e.g. worker is stopping before handling it
+var ErrRequeue = errors.New("requeue message")
+
+// message moved to dead letter queue after failed deliveries
+type DeadLetter struct {
+	Body []byte
+	// queue that message was consumed from
+	Queue   string
+	Error   string
+	Retries int
+	DeadAt  time.Time
+}
+
+// ack message if it's handled, requeue it at its position if handler asks for it,
+// otherwise send it to the queue again, or to dead letter exchange after MaxRedeliveries.
+// channel and queue are the ones message was consumed from, they may be reconnected since then.
+func (r *RabbitMqManager) settle(channel *amqp.Channel, queue string, msg amqp.Delivery, handleErr error) {
+	if handleErr == nil {
+		if err := msg.Ack(false); err != nil {
+			logger.ErrorLogger.Printf("ack message error: %v\n", err)
+		}
+		return
+	}
+	if errors.Is(handleErr, ErrRequeue) {
+		if err := msg.Nack(false, true); err != nil {
+			logger.ErrorLogger.Printf("nack message error: %v\n", err)
+		}
+		return
+	}
+
+	retries := retryCount(msg.Headers)
+	var err error
+	if retries < r.MaxRedeliveries {
+		logger.WarningLogger.Printf("redeliver message, retry %d of %d\n", retries+1, r.MaxRedeliveries)
+		err = r.publish(channel, "", queue, msg, amqp.Table{retryCountHeader: int32(retries + 1)})
+	} else if len(r.DeadLetterExchange) > 0 {
+		logger.ErrorLogger.Printf("move message to dead letter queue after %d retries: %s\n", retries, string(msg.Body))
+		err = r.publish(channel, r.DeadLetterExchange, r.QueueName, msg, amqp.Table{
+			retryCountHeader:    int32(retries),
+			originalQueueHeader: queue,
+			errorHeader:         handleErr.Error(),
+		})
+	} else {
+		logger.ErrorLogger.Printf("drop message after %d retries: %s\n", retries, string(msg.Body))
+	}
+
+	if err != nil {
+		// broker delivers it again later
+		logger.ErrorLogger.Printf("republish message error, requeue it: %v\n", err)
+		if err := msg.Nack(false, true); err != nil {
+			logger.ErrorLogger.Printf("nack message error: %v\n", err)
+		}
+		return
+	}
+	if err := msg.Ack(false); err != nil {
+		logger.ErrorLogger.Printf("ack message error: %v\n", err)
+	}
+}
+
+// publish a copy of received message, it's confirmed before original message is acked
+func (r *RabbitMqManager) publish(channel *amqp.Channel, exchange, key string, msg amqp.Delivery, headers amqp.Table) error {
+	return publishConfirmed(channel, exchange, key, amqp.Publishing{
+		ContentType:  msg.ContentType,
+		DeliveryMode: r.deliveryMode(),
+		Headers:      headers,
+		Priority:     msg.Priority,
+		Timestamp:    time.Now(),
+		Body:         msg.Body,
+	})
+}
+
+func retryCount(headers amqp.Table) int {
+	switch v := headers[retryCountHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 0
+	}
+}
+
+// declare dead letter exchange and queue, dead letters of QueueName are routed by its name
+func (r *RabbitMqManager) declareDeadLetter() error {
+	err := r.channel.ExchangeDeclare(r.DeadLetterExchange, amqp.ExchangeDirect, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("Init error when declare dead letter exchange: %v", err)
+	}
+	_, err = r.channel.QueueDeclare(r.DeadLetterQueue, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("Init error when declare dead letter queue: %v", err)
+	}
+	err = r.channel.QueueBind(r.DeadLetterQueue, r.QueueName, r.DeadLetterExchange, false, nil)
+	if err != nil {
+		return fmt.Errorf("Init error when bind dead letter queue: %v", err)
+	}
+	return nil
+}
+
+// @description list messages in dead letter queue without removing them
+// @param limit int max messages returned
+// @return []*DeadLetter
+// @return error
+func (r *RabbitMqManager) ListDeadLetters(limit int) ([]*DeadLetter, error) {
+	res := make([]*DeadLetter, 0)
+	err := r.walkDeadLetters(limit, func(msg amqp.Delivery, letter *DeadLetter) error {
+		res = append(res, letter)
+		// unacked messages are back to queue when channel is closed
+		return nil
+	})
+	return res, err
+}
+
+// @description send messages in dead letter queue back to QueueName
+// @param limit int max messages replayed
+// @param match func(*DeadLetter) bool only matched messages are replayed, others are kept
+// @return int number of messages replayed
+// @return error
+func (r *RabbitMqManager) ReplayDeadLetters(limit int, match func(*DeadLetter) bool) (int, error) {
+	replayed := 0
+	err := r.walkDeadLetters(0, func(msg amqp.Delivery, letter *DeadLetter) error {
+		if (limit > 0 && replayed >= limit) || !match(letter) {
+			return nil
+		}
+		// replayed message starts with no retry
+		if err := r.publish(r.channel, "", letter.Queue, msg, nil); err != nil {
+			return fmt.Errorf("replay message error: %v", err)
+		}
+		if err := msg.Ack(false); err != nil {
+			return fmt.Errorf("ack dead letter error: %v", err)
+		}
+		replayed++
+		return nil
+	})
+	return replayed, err
+}
+
+// get every message in dead letter queue without auto ack, they
+// are back to queue when channel is reset unless visit acks them
+func (r *RabbitMqManager) walkDeadLetters(limit int, visit func(amqp.Delivery, *DeadLetter) error) error {
+	if len(r.DeadLetterExchange) == 0 {
+		return fmt.Errorf("dead letter exchange is not configured")
+	}
+	err := r.initQueue()
+	defer r.reset()
+	if err != nil {
+		return err
+	}
+
+	for count := 0; limit <= 0 || count < limit; count++ {
+		msg, ok, err := r.channel.Get(r.DeadLetterQueue, false)
+		if err != nil {
+			return fmt.Errorf("get dead letter error: %v", err)
+		}
+		if !ok {
+			return nil
+		}
+
+		letter := &DeadLetter{
+			Body:    msg.Body,
+			Queue:   r.QueueName,
+			Retries: retryCount(msg.Headers),
+			DeadAt:  msg.Timestamp,
+		}
+		if queue, ok := msg.Headers[originalQueueHeader].(string); ok {
+			letter.Queue = queue
+		}
+		if reason, ok := msg.Headers[errorHeader].(string); ok {
+			letter.Error = reason
+		}
+		if err := visit(msg, letter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package tools
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// @description check duration flags used as intervals of tickers, which panic if they're not positive
+// @param durations map[string]time.Duration flag name to its value
+// @return error listing flags that are not positive
+func CheckPositiveDurations(durations map[string]time.Duration) error {
+	names := make([]string, 0, len(durations))
+	for name, duration := range durations {
+		if duration <= 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return fmt.Errorf("flags %s should be positive durations", "-"+strings.Join(names, ", -"))
+}
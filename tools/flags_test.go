@@ -0,0 +1,16 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckPositiveDurations(t *testing.T) {
+	err := CheckPositiveDurations(map[string]time.Duration{"heartbeat": time.Second, "timeout": 0, "interval": -time.Second})
+	if err == nil || err.Error() != "flags -interval, -timeout should be positive durations" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := CheckPositiveDurations(map[string]time.Duration{"heartbeat": time.Second}); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
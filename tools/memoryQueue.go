@@ -0,0 +1,354 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/averitas/courier_go/tools/logger"
+)
+
+const MemoryQueueScheme = "mem://"
+
+// in-process brokers by name, managers with same mem:// connection string share a broker
+var (
+	memoryBrokersMu sync.Mutex
+	memoryBrokers   = make(map[string]*memoryBroker)
+)
+
+type memoryBroker struct {
+	mu     sync.Mutex
+	queues map[string]*memoryQueue
+	// queues bound to fanout exchanges
+	exchanges map[string]map[*memoryQueue]struct{}
+}
+
+type memoryMessage struct {
+	body     []byte
+	priority uint8
+	retries  int
+}
+
+// memoryQueue is a FIFO queue, receivers wait on notify for new messages
+type memoryQueue struct {
+	mu       sync.Mutex
+	messages []*memoryMessage
+	notify   chan struct{}
+	// count of running receivers
+	receivers int
+}
+
+func getMemoryBroker(name string) *memoryBroker {
+	memoryBrokersMu.Lock()
+	defer memoryBrokersMu.Unlock()
+
+	broker, ok := memoryBrokers[name]
+	if !ok {
+		broker = &memoryBroker{
+			queues:    make(map[string]*memoryQueue),
+			exchanges: make(map[string]map[*memoryQueue]struct{}),
+		}
+		memoryBrokers[name] = broker
+	}
+	return broker
+}
+
+func newMemoryQueue() *memoryQueue {
+	return &memoryQueue{notify: make(chan struct{}, 1)}
+}
+
+func (b *memoryBroker) queue(name string) *memoryQueue {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		q = newMemoryQueue()
+		b.queues[name] = q
+	}
+	return q
+}
+
+func (b *memoryBroker) bind(exchange string, q *memoryQueue) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.exchanges[exchange]; !ok {
+		b.exchanges[exchange] = make(map[*memoryQueue]struct{})
+	}
+	b.exchanges[exchange][q] = struct{}{}
+}
+
+func (b *memoryBroker) unbind(exchange string, q *memoryQueue) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.exchanges[exchange], q)
+}
+
+// broadcast message to all queues bound to exchange, it's dropped if no queue bound
+func (b *memoryBroker) fanout(exchange string, msg *memoryMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for q := range b.exchanges[exchange] {
+		q.push(&memoryMessage{body: msg.body, priority: msg.priority})
+	}
+}
+
+// append message after messages with same or higher priority
+func (q *memoryQueue) push(msg *memoryMessage) {
+	q.mu.Lock()
+	i := len(q.messages)
+	for i > 0 && q.messages[i-1].priority < msg.priority {
+		i--
+	}
+	q.insert(i, msg)
+	q.mu.Unlock()
+	q.wake()
+}
+
+// put message back before messages with same or lower priority
+func (q *memoryQueue) requeue(msg *memoryMessage) {
+	q.mu.Lock()
+	i := 0
+	for i < len(q.messages) && q.messages[i].priority > msg.priority {
+		i++
+	}
+	q.insert(i, msg)
+	q.mu.Unlock()
+	q.wake()
+}
+
+// insert message at i, q.mu should be locked
+func (q *memoryQueue) insert(i int, msg *memoryMessage) {
+	q.messages = append(q.messages, nil)
+	copy(q.messages[i+1:], q.messages[i:])
+	q.messages[i] = msg
+}
+
+// wake a receiver waiting for messages
+func (q *memoryQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop first message, wait until there is one or ctx is done
+func (q *memoryQueue) pop(ctx context.Context) (*memoryMessage, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.messages) > 0 {
+			msg := q.messages[0]
+			q.messages = q.messages[1:]
+			more := len(q.messages) > 0
+			q.mu.Unlock()
+			// wake other receivers waiting for remaining messages
+			if more {
+				q.wake()
+			}
+			return msg, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-q.notify:
+		}
+	}
+}
+
+func (q *memoryQueue) addReceivers(delta int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.receivers += delta
+}
+
+func (q *memoryQueue) hasReceivers() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.receivers > 0
+}
+
+func (q *memoryQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+// MemoryQueueManager is an in-process queue with the same behavior of RabbitMqManager:
+// FIFO queue QueueName or fanout exchange ExchangeName, messages removed after handled,
+// failed messages redelivered MaxRedeliveries times, then moved to DeadLetterQueue.
+// Messages are lost when process exits. Only receivers in the same process get messages,
+// so it's for tests running senders and receivers together, not for apiserver and workers
+// in separate processes. Sending to a queue without running receivers fails instead of
+// leaving messages nobody will handle.
+type MemoryQueueManager struct {
+	// name of broker shared by managers in this process
+	Broker       string
+	QueueName    string
+	ExchangeName string
+
+	Concurrency int
+	// deliver messages implementing Prioritized by priority, 0 for FIFO only
+	MaxPriority     uint8
+	MaxRedeliveries int
+	DeadLetterQueue string
+
+	broker *memoryBroker
+}
+
+func (m *MemoryQueueManager) Init() error {
+	m.broker = getMemoryBroker(m.Broker)
+	return nil
+}
+
+// Send put message to queue, it's confirmed once it's in queue.
+// Return error if no receiver of queue is running in this process
+func (m *MemoryQueueManager) Send(message interface{}) error {
+	if m.broker == nil {
+		return fmt.Errorf("please init queue first")
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("marshal message to json string error: %v", err)
+	}
+
+	msg := &memoryMessage{body: body}
+	if len(m.ExchangeName) > 0 {
+		m.broker.fanout(m.ExchangeName, msg)
+	} else {
+		q := m.broker.queue(m.QueueName)
+		if !q.hasReceivers() {
+			return fmt.Errorf("no receiver of memory queue [%s] is running in this process", m.QueueName)
+		}
+		msg.priority = messagePriority(message)
+		if msg.priority > m.MaxPriority {
+			msg.priority = m.MaxPriority
+		}
+		q.push(msg)
+	}
+	return nil
+}
+
+// StartSender wait until ctx is done, messages are sent by Send directly
+func (m *MemoryQueueManager) StartSender(ctx context.Context) {
+	<-ctx.Done()
+	logger.InfoLogger.Println("background memory queue sender stopped")
+}
+
+// StartReceiver handle messages with at most Concurrency handlers until ctx is done
+func (m *MemoryQueueManager) StartReceiver(ctx context.Context, handler MessageHandler) error {
+	if m.broker == nil {
+		return fmt.Errorf("please init queue first")
+	}
+
+	var q *memoryQueue
+	if len(m.ExchangeName) > 0 {
+		// every receiver has its own queue like exclusive queue of RabbitMQ
+		q = newMemoryQueue()
+		m.broker.bind(m.ExchangeName, q)
+		defer m.broker.unbind(m.ExchangeName, q)
+	} else {
+		q = m.broker.queue(m.QueueName)
+		q.addReceivers(1)
+		defer q.addReceivers(-1)
+	}
+
+	concurrency := m.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var handlers sync.WaitGroup
+	handlers.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer handlers.Done()
+			// messages left in queue aren't taken once ctx is done
+			for ctx.Err() == nil {
+				msg, ok := q.pop(ctx)
+				if !ok {
+					return
+				}
+				m.handle(q, msg, handler)
+			}
+		}()
+	}
+	handlers.Wait()
+
+	logger.InfoLogger.Println("background memory queue receiver stopped")
+	return nil
+}
+
+func (m *MemoryQueueManager) handle(q *memoryQueue, msg *memoryMessage, handler MessageHandler) {
+	err := runWrapHandler(func() error {
+		return handler(msg.body)
+	})
+	if err == nil {
+		return
+	}
+	if errors.Is(err, ErrRequeue) {
+		q.requeue(msg)
+		return
+	}
+	logger.ErrorLogger.Printf("call wrap handler of message [%v] error: %v\n", string(msg.body), err)
+
+	if msg.retries < m.MaxRedeliveries {
+		msg.retries++
+		q.push(msg)
+	} else if len(m.DeadLetterQueue) > 0 {
+		logger.ErrorLogger.Printf("move message to dead letter queue after %d retries: %s\n", msg.retries, string(msg.body))
+		m.broker.queue(m.DeadLetterQueue).push(msg)
+	} else {
+		logger.ErrorLogger.Printf("drop message after %d retries: %s\n", msg.retries, string(msg.body))
+	}
+}
+
+// QueueOptions configure queue manager created by NewQueueManager,
+// see RabbitMqManager for meaning of fields
+type QueueOptions struct {
+	QueueName    string
+	ExchangeName string
+	Transient    bool
+	Concurrency  int
+	MaxPriority  uint8
+
+	MaxRedeliveries    int
+	DeadLetterExchange string
+	DeadLetterQueue    string
+}
+
+// @description create queue by scheme of connection string,
+// mem://{name} for in-process queue, otherwise RabbitMQ
+// @param connString string
+// @param options QueueOptions
+// @return IQueueBackend
+func NewQueueManager(connString string, options QueueOptions) IQueueBackend {
+	if strings.HasPrefix(connString, MemoryQueueScheme) {
+		return &MemoryQueueManager{
+			Broker:          strings.TrimPrefix(connString, MemoryQueueScheme),
+			QueueName:       options.QueueName,
+			ExchangeName:    options.ExchangeName,
+			Concurrency:     options.Concurrency,
+			MaxPriority:     options.MaxPriority,
+			MaxRedeliveries: options.MaxRedeliveries,
+			DeadLetterQueue: options.DeadLetterQueue,
+		}
+	}
+	return &RabbitMqManager{
+		ConnString:         connString,
+		QueueName:          options.QueueName,
+		ExchangeName:       options.ExchangeName,
+		Transient:          options.Transient,
+		Concurrency:        options.Concurrency,
+		MaxPriority:        options.MaxPriority,
+		MaxRedeliveries:    options.MaxRedeliveries,
+		DeadLetterExchange: options.DeadLetterExchange,
+		DeadLetterQueue:    options.DeadLetterQueue,
+	}
+}
@@ -0,0 +1,134 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sender := NewQueueManager("mem://TestMemoryQueue", QueueOptions{QueueName: "orders"})
+	receiver := NewQueueManager("mem://TestMemoryQueue", QueueOptions{
+		QueueName:       "orders",
+		MaxRedeliveries: 2,
+		DeadLetterQueue: "dead",
+	})
+	if err := sender.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := receiver.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody in this process would receive it
+	if err := sender.Send(0); err == nil {
+		t.Fatalf("expected error of sending to queue without receivers")
+	}
+
+	var mu sync.Mutex
+	var received []string
+	sent := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		receiver.StartReceiver(ctx, func(b []byte) error {
+			// handle after all messages are queued
+			<-sent
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, string(b))
+			if string(b) == "1" {
+				return fmt.Errorf("failed")
+			}
+			return nil
+		})
+	}()
+
+	queue := getMemoryBroker("TestMemoryQueue").queue("orders")
+	for !queue.hasReceivers() {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sender.Send(i); err != nil {
+			t.Fatalf("send message %d error: %v", i, err)
+		}
+	}
+	close(sent)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n == 5 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	// message 1 is delivered once and redelivered twice after others
+	expected := []string{"0", "1", "2", "1", "1"}
+	if fmt.Sprint(received) != fmt.Sprint(expected) {
+		t.Errorf("expected received %v, got %v", expected, received)
+	}
+	dead := getMemoryBroker("TestMemoryQueue").queue("dead")
+	if dead.len() != 1 {
+		t.Errorf("expected 1 message in dead letter queue, got %d", dead.len())
+	}
+}
+
+func TestMemoryQueueRequeue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	manager := NewQueueManager("mem://TestMemoryQueueRequeue", QueueOptions{QueueName: "orders", DeadLetterQueue: "dead"})
+	if err := manager.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var received []string
+	sent := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		manager.StartReceiver(ctx, func(b []byte) error {
+			<-sent
+			received = append(received, string(b))
+			if len(received) == 1 {
+				return fmt.Errorf("%w: not ready", ErrRequeue)
+			}
+			if len(received) == 3 {
+				cancel()
+			}
+			return nil
+		})
+	}()
+
+	queue := getMemoryBroker("TestMemoryQueueRequeue").queue("orders")
+	for !queue.hasReceivers() {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		if err := manager.Send(i); err != nil {
+			t.Fatalf("send message %d error: %v", i, err)
+		}
+	}
+	close(sent)
+	<-done
+
+	// requeued message keeps its position without counted as a failed delivery
+	expected := []string{"0", "0", "1"}
+	if fmt.Sprint(received) != fmt.Sprint(expected) {
+		t.Errorf("expected received %v, got %v", expected, received)
+	}
+	if dead := getMemoryBroker("TestMemoryQueueRequeue").queue("dead"); dead.len() != 0 {
+		t.Errorf("requeued message should not be dead lettered, got %d", dead.len())
+	}
+}
@@ -3,7 +3,10 @@ package tools
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/averitas/courier_go/tools/logger"
@@ -16,14 +19,80 @@ type IQueueManager interface {
 	Send(interface{}) error
 }
 
+// IQueueBackend is a queue servers send messages to and receive from,
+// implemented by RabbitMqManager and MemoryQueueManager
+type IQueueBackend interface {
+	IQueueManager
+	// connect to queue, must be called before other methods
+	Init() error
+	// send messages in background until ctx is done
+	StartSender(ctx context.Context)
+	// handle received messages until ctx is done
+	StartReceiver(ctx context.Context, handler MessageHandler) error
+}
+
+const (
+	// how long Send waits for message sent and confirmed by broker
+	sendTimeout = 30 * time.Second
+	// how long a publish waits for confirmation of broker
+	confirmTimeout = 5 * time.Second
+	// backoff of reconnecting after connection lost
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// Prioritized is implemented by messages published with a priority,
+// it takes effect only if queue is declared with MaxPriority
+type Prioritized interface {
+	MessagePriority() uint8
+}
+
+func messagePriority(msg interface{}) uint8 {
+	if p, ok := msg.(Prioritized); ok {
+		return p.MessagePriority()
+	}
+	return 0
+}
+
+// message waiting for background sender, result of publish is sent back to result
+type sendRequest struct {
+	msg    interface{}
+	result chan error
+}
+
+// RabbitMqManager send messages to queue QueueName and receive from it.
+// If ExchangeName is set, messages are broadcast by a fanout exchange instead,
+// every receiver consumes its own exclusive queue bound to the exchange.
+// Received messages are acked after handler succeed. Failed messages are sent
+// to the queue again for MaxRedeliveries times, then moved to DeadLetterQueue
+// through DeadLetterExchange, or dropped if DeadLetterExchange is not set.
+// QueueName is durable and messages are persistent unless Transient is set.
+// Channels are in confirm mode, a message is sent only if broker acks it.
+// If MaxPriority is set, QueueName is a priority queue and messages implementing
+// Prioritized are delivered by their priority.
 type RabbitMqManager struct {
-	ConnString     string
-	QueueName      string
-	MessageChannel chan interface{}
+	ConnString   string
+	QueueName    string
+	ExchangeName string
+	// declare non-durable queue and publish non-persistent messages
+	Transient bool
+	// max messages handled at once by receiver, also the prefetch count of consumer.
+	// Messages are handled one by one if less than 1
+	Concurrency int
+	// declare QueueName with x-max-priority, 0 for a normal queue
+	MaxPriority uint8
 
-	queue   *amqp.Queue
-	channel *amqp.Channel
-	conn    *amqp.Connection
+	MaxRedeliveries    int
+	DeadLetterExchange string
+	DeadLetterQueue    string
+
+	messages chan *sendRequest
+	queue    *amqp.Queue
+	channel  *amqp.Channel
+	conn     *amqp.Connection
+	// connected before, so dialing again is a reconnect
+	connected  bool
+	reconnects atomic.Int64
 }
 
 func (r *RabbitMqManager) Init() error {
@@ -32,17 +101,47 @@ func (r *RabbitMqManager) Init() error {
 	if err != nil {
 		return fmt.Errorf("Init error when dial to server: %v", err)
 	}
-	r.MessageChannel = make(chan interface{}, 5)
+	r.connected = true
+	r.messages = make(chan *sendRequest, 5)
 	return nil
 }
 
+// Reconnects return how many times connection was established again after lost
+func (r *RabbitMqManager) Reconnects() int64 {
+	return r.reconnects.Load()
+}
+
+// delay before reconnect after failures, doubled every failure and at most maxReconnectDelay
+func reconnectDelay(failures int) time.Duration {
+	delay := minReconnectDelay
+	for i := 0; i < failures && delay < maxReconnectDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxReconnectDelay {
+		delay = maxReconnectDelay
+	}
+	return delay
+}
+
+// Send message by background sender and wait until broker confirmed it,
+// return error if broker nacked it or it's not confirmed in time
 func (r *RabbitMqManager) Send(msg interface{}) error {
+	req := &sendRequest{
+		msg:    msg,
+		result: make(chan error, 1),
+	}
 	select {
-	case r.MessageChannel <- msg:
-		return nil
+	case r.messages <- req:
 	case <-time.After(time.Second):
 		return fmt.Errorf("send message timeout, maybe too busy")
 	}
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-time.After(sendTimeout):
+		return fmt.Errorf("wait for message confirmed timeout")
+	}
 }
 
 func (r *RabbitMqManager) StartSender(ctx context.Context) {
@@ -51,49 +150,140 @@ Loop:
 		select {
 		case <-ctx.Done():
 			break Loop
-		case msg := <-r.MessageChannel:
-			r.SendMessage(msg)
+		case req := <-r.messages:
+			err := r.SendMessage(req.msg)
+			if err != nil {
+				logger.ErrorLogger.Printf("send message error: %v\n", err)
+			}
+			req.result <- err
 		}
 	}
 	logger.InfoLogger.Println("signal received, start to stop queue sender")
+	// fail messages still waiting so callers don't wait for timeout
+	for len(r.messages) > 0 {
+		req := <-r.messages
+		req.result <- fmt.Errorf("queue sender stopped")
+	}
 	r.reset()
 	logger.InfoLogger.Println("background queue sender stopped")
 }
 
-func (r *RabbitMqManager) StartReceiver(ctx context.Context, handler MessageHandler) (err error) {
+// StartReceiver consume messages with handler until ctx is done. If connection or
+// channel is closed, it reconnects with backoff and resumes consuming. Error is
+// returned only if it couldn't start consuming at all, e.g. queue declaration failed.
+func (r *RabbitMqManager) StartReceiver(ctx context.Context, handler MessageHandler) error {
+	everStarted := false
+	failures := 0
+	for {
+		started, err := r.consume(ctx, handler)
+		if ctx.Err() != nil {
+			break
+		}
+		r.reset()
+		if !everStarted && !started {
+			return err
+		}
+		everStarted = true
+
+		// backoff restarts after consuming successfully for a while
+		if started {
+			failures = 0
+		}
+		delay := reconnectDelay(failures)
+		failures++
+		logger.WarningLogger.Printf("queue receiver lost connection: %v, reconnect in %v\n", err, delay)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+
+	logger.InfoLogger.Println("signal received, start to stop queue receiver")
+	r.reset()
+	logger.InfoLogger.Println("background queue receiver stopped")
+	return nil
+}
+
+// consume messages until ctx is done or connection is lost,
+// started is false if consuming couldn't start
+func (r *RabbitMqManager) consume(ctx context.Context, handler MessageHandler) (started bool, err error) {
 	defer func() {
 		if rcy := recover(); rcy != nil {
-			err = fmt.Errorf("send error: %v\n!panic: %v", err, rcy)
+			err = fmt.Errorf("receive error: %v\n!panic: %v", err, rcy)
 		}
 	}()
 	err = r.initQueue()
+	if err != nil {
+		return
+	}
+	if len(r.ExchangeName) > 0 {
+		err = r.bindExchangeQueue()
+		if err != nil {
+			return
+		}
+	}
+
+	concurrency := 1
+	if r.Concurrency > 0 {
+		concurrency = r.Concurrency
+		// broker doesn't deliver more messages than we could handle, others are left for other workers
+		err = r.channel.Qos(concurrency, 0, false)
+		if err != nil {
+			return
+		}
+	}
 
-	msgs, err := r.channel.Consume(
-		r.queue.Name, "consumer", true, false, false, false, nil,
+	channel, queue := r.channel, r.queue.Name
+	connClosed := r.conn.NotifyClose(make(chan *amqp.Error, 1))
+	channelClosed := r.channel.NotifyClose(make(chan *amqp.Error, 1))
+	msgs, err := channel.Consume(
+		queue, "consumer", false, false, false, false, nil,
 	)
-RLoop:
+	if err != nil {
+		return
+	}
+	started = true
+
+	// message is acked after its handler finished, wait handlers running before stopping.
+	// If channel is closed their messages can't be acked and are delivered again,
+	// so don't wait them before reconnecting, handler should skip messages it's still handling
+	slots := make(chan struct{}, concurrency)
+	var handlers sync.WaitGroup
 	for {
 		select {
 		case <-ctx.Done():
-			break RLoop
-		case msg := <-msgs:
-			err = r.runWrapHandler(func() error {
-				return handler(msg.Body)
-			})
-			if err != nil {
-				logger.ErrorLogger.Printf("call wrap handler of message [%v] error: %v\n", string(msg.Body), err)
+			handlers.Wait()
+			return
+		case cerr := <-connClosed:
+			return started, fmt.Errorf("connection closed: %v", cerr)
+		case cerr := <-channelClosed:
+			return started, fmt.Errorf("channel closed: %v", cerr)
+		case msg, ok := <-msgs:
+			if !ok {
+				return started, fmt.Errorf("delivery channel closed")
 			}
+			slots <- struct{}{}
+			handlers.Add(1)
+			go func() {
+				defer func() {
+					<-slots
+					handlers.Done()
+				}()
+				herr := runWrapHandler(func() error {
+					return handler(msg.Body)
+				})
+				if errors.Is(herr, ErrRequeue) {
+					logger.InfoLogger.Printf("requeue message [%v]: %v\n", string(msg.Body), herr)
+				} else if herr != nil {
+					logger.ErrorLogger.Printf("call wrap handler of message [%v] error: %v\n", string(msg.Body), herr)
+				}
+				r.settle(channel, queue, msg, herr)
+			}()
 		}
 	}
-
-	logger.InfoLogger.Println("signal received, start to stop queue receiver")
-	r.reset()
-	logger.InfoLogger.Println("background queue receiver stopped")
-
-	return
 }
 
-func (r *RabbitMqManager) runWrapHandler(handler func() error) (err error) {
+func runWrapHandler(handler func() error) (err error) {
 	defer func() {
 		if rcy := recover(); rcy != nil {
 			err = fmt.Errorf("handler error: %v\n!panic: %v", err, rcy)
@@ -104,55 +294,107 @@ func (r *RabbitMqManager) runWrapHandler(handler func() error) (err error) {
 	return
 }
 
+// SendMessage publish message on current channel, if it fails the
+// connection is reset and message is sent again after backoff
 func (r *RabbitMqManager) SendMessage(msg interface{}) error {
-	if r.conn == nil {
-		return fmt.Errorf("please init queue first")
-	}
-
 	msgBodyBytes, err := json.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("marshal message to json string error: %v", err)
 	}
 
 	for i := 0; i < 3; i += 1 {
+		if i > 0 {
+			delay := reconnectDelay(i - 1)
+			logger.WarningLogger.Printf("queue sender lost connection: %v, reconnect in %v\n", err, delay)
+			r.reset()
+			time.Sleep(delay)
+		}
 		err = r.initQueue()
 		if err != nil {
 			continue
 		}
-		err = r.sendInner(msgBodyBytes)
+		err = r.sendInner(msgBodyBytes, messagePriority(msg))
 		if err == nil {
 			return nil
 		}
-
-		r.reset()
 	}
 
 	return fmt.Errorf("Send failed with 3 tries %v", err)
 }
 
-func (r *RabbitMqManager) sendInner(message []byte) (err error) {
+func (r *RabbitMqManager) sendInner(message []byte, priority uint8) (err error) {
 	defer func() {
 		if rcy := recover(); rcy != nil {
 			err = fmt.Errorf("send error: %v\n!panic: %v", err, rcy)
 		}
 	}()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	err = r.channel.PublishWithContext(ctx, "", r.queue.Name, false, false, amqp.Publishing{
-		ContentType: "text/json",
-		Body:        message,
+	exchange, key := "", r.QueueName
+	if len(r.ExchangeName) > 0 {
+		exchange, key = r.ExchangeName, ""
+	}
+	err = publishConfirmed(r.channel, exchange, key, amqp.Publishing{
+		ContentType:  "text/json",
+		DeliveryMode: r.deliveryMode(),
+		Priority:     priority,
+		Body:         message,
 	})
 	return
 }
 
+// publish message and wait for confirmation if channel is in confirm mode
+func publishConfirmed(channel *amqp.Channel, exchange, key string, msg amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(context.Background(), confirmTimeout)
+	defer cancel()
+
+	confirm, err := channel.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, msg)
+	if err != nil {
+		return err
+	}
+	if confirm == nil {
+		return nil
+	}
+
+	// Wait returns false when channel is closed, so the goroutine doesn't leak
+	// after channel of the timed out publish is reset
+	acked := make(chan bool, 1)
+	go func() {
+		acked <- confirm.Wait()
+	}()
+	select {
+	case ack := <-acked:
+		if !ack {
+			return fmt.Errorf("message is nacked by broker")
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("wait for broker confirm error: %v", ctx.Err())
+	}
+}
+
+func (r *RabbitMqManager) deliveryMode() uint8 {
+	if r.Transient {
+		return amqp.Transient
+	}
+	return amqp.Persistent
+}
+
+// open connection and channel if they are not open, then declare queue or exchange
 func (r *RabbitMqManager) initQueue() (err error) {
-	if r.conn == nil {
+	if r.conn == nil || r.conn.IsClosed() {
+		r.channel = nil
 		r.conn, err = amqp.Dial(r.ConnString)
 		if err != nil {
 			return fmt.Errorf("Init error when dial to server: %v", err)
 		}
+		if r.connected {
+			reconnects := r.reconnects.Add(1)
+			logger.InfoLogger.Printf("reconnected to queue server, %d reconnects so far\n", reconnects)
+		}
+		r.connected = true
+	}
+	if r.channel != nil && !r.channel.IsClosed() {
+		return nil
 	}
 
 	// init queue
@@ -160,12 +402,44 @@ func (r *RabbitMqManager) initQueue() (err error) {
 	if err != nil {
 		return fmt.Errorf("Init error when create channel: %v", err)
 	}
+	err = r.channel.Confirm(false)
+	if err != nil {
+		return fmt.Errorf("Init error when enable publisher confirms: %v", err)
+	}
 
-	queue, err := r.channel.QueueDeclare(r.QueueName, false, false, false, false, nil)
+	if len(r.ExchangeName) > 0 {
+		err = r.channel.ExchangeDeclare(r.ExchangeName, amqp.ExchangeFanout, false, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("Init error when declare exchange: %v", err)
+		}
+		return nil
+	}
+
+	queue, err := r.declareQueue(r.channel, r.QueueName)
 	r.queue = &queue
-	if err != nil {
+	if isAmqpError(err, amqp.PreconditionFailed) {
+		return fmt.Errorf("Init error when declare queue: %v, queue %s exists with different arguments, "+
+			"please migrate it by MigrateQueue", err, r.QueueName)
+	} else if err != nil {
 		return fmt.Errorf("Init error when declare queue: %v", err)
 	}
+	if len(r.DeadLetterExchange) > 0 {
+		return r.declareDeadLetter()
+	}
+	return nil
+}
+
+// declare an exclusive queue of this receiver and bind it to exchange
+func (r *RabbitMqManager) bindExchangeQueue() error {
+	queue, err := r.channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return fmt.Errorf("Init error when declare exclusive queue: %v", err)
+	}
+	r.queue = &queue
+	err = r.channel.QueueBind(queue.Name, "", r.ExchangeName, false, nil)
+	if err != nil {
+		return fmt.Errorf("Init error when bind queue to exchange %s: %v", r.ExchangeName, err)
+	}
 	return nil
 }
 
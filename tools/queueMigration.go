@@ -0,0 +1,128 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/averitas/courier_go/tools/logger"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// declare queue with durability and arguments of this manager
+func (r *RabbitMqManager) declareQueue(channel *amqp.Channel, name string) (amqp.Queue, error) {
+	var args amqp.Table
+	if r.MaxPriority > 0 {
+		args = amqp.Table{"x-max-priority": r.MaxPriority}
+	}
+	return channel.QueueDeclare(name, !r.Transient, false, false, false, args)
+}
+
+func isAmqpError(err error, code int) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == code
+}
+
+// @description Recreate QueueName if it was declared with different durability or
+// arguments, e.g. a non-durable queue created by old version. Pending messages are
+// moved to a temporary queue and back, so they are kept. Consumers of the queue
+// must be stopped before migration. It does nothing if queue doesn't need migration.
+// @return error
+func (r *RabbitMqManager) MigrateQueue() error {
+	conn, err := amqp.Dial(r.ConnString)
+	if err != nil {
+		return fmt.Errorf("dial to server error: %v", err)
+	}
+	defer conn.Close()
+
+	// broker closes channel on failed declaration, so every check uses a new channel
+	channel, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("create channel error: %v", err)
+	}
+	old, err := channel.QueueDeclarePassive(r.QueueName, false, false, false, false, nil)
+	if isAmqpError(err, amqp.NotFound) {
+		logger.InfoLogger.Printf("queue %s doesn't exist, no need to migrate\n", r.QueueName)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("inspect queue %s error: %v", r.QueueName, err)
+	}
+
+	channel, err = conn.Channel()
+	if err != nil {
+		return fmt.Errorf("create channel error: %v", err)
+	}
+	_, err = r.declareQueue(channel, r.QueueName)
+	if err == nil {
+		logger.InfoLogger.Printf("queue %s is up to date, no need to migrate\n", r.QueueName)
+		return channel.Close()
+	} else if !isAmqpError(err, amqp.PreconditionFailed) {
+		return fmt.Errorf("declare queue %s error: %v", r.QueueName, err)
+	}
+	if old.Consumers > 0 {
+		return fmt.Errorf("queue %s has %d consumers, please stop workers before migration", r.QueueName, old.Consumers)
+	}
+
+	channel, err = conn.Channel()
+	if err != nil {
+		return fmt.Errorf("create channel error: %v", err)
+	}
+	defer channel.Close()
+	if err = channel.Confirm(false); err != nil {
+		return fmt.Errorf("enable publisher confirms error: %v", err)
+	}
+
+	temp := r.QueueName + ".migrating"
+	if _, err = r.declareQueue(channel, temp); err != nil {
+		return fmt.Errorf("declare temporary queue %s error: %v", temp, err)
+	}
+	moved, err := r.moveMessages(channel, r.QueueName, temp)
+	if err != nil {
+		return err
+	}
+	logger.InfoLogger.Printf("moved %d messages of %s to %s\n", moved, r.QueueName, temp)
+
+	if _, err = channel.QueueDelete(r.QueueName, false, false, false); err != nil {
+		return fmt.Errorf("delete queue %s error: %v", r.QueueName, err)
+	}
+	if _, err = r.declareQueue(channel, r.QueueName); err != nil {
+		return fmt.Errorf("declare queue %s error: %v", r.QueueName, err)
+	}
+	if _, err = r.moveMessages(channel, temp, r.QueueName); err != nil {
+		return err
+	}
+	if _, err = channel.QueueDelete(temp, false, true, false); err != nil {
+		return fmt.Errorf("delete temporary queue %s error: %v", temp, err)
+	}
+	logger.InfoLogger.Printf("queue %s migrated with %d messages\n", r.QueueName, moved)
+	return nil
+}
+
+// move all messages of queue from to queue to, keeping their order
+func (r *RabbitMqManager) moveMessages(channel *amqp.Channel, from, to string) (int, error) {
+	moved := 0
+	for {
+		msg, ok, err := channel.Get(from, false)
+		if err != nil {
+			return moved, fmt.Errorf("get message of %s error: %v", from, err)
+		}
+		if !ok {
+			return moved, nil
+		}
+
+		err = publishConfirmed(channel, "", to, amqp.Publishing{
+			ContentType:  msg.ContentType,
+			DeliveryMode: r.deliveryMode(),
+			Headers:      msg.Headers,
+			Priority:     msg.Priority,
+			Timestamp:    msg.Timestamp,
+			Body:         msg.Body,
+		})
+		if err != nil {
+			return moved, fmt.Errorf("move message to %s error: %v", to, err)
+		}
+		if err = msg.Ack(false); err != nil {
+			return moved, fmt.Errorf("ack message of %s error: %v", from, err)
+		}
+		moved++
+	}
+}
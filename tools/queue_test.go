@@ -0,0 +1,15 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	for failures, delay := range expected {
+		if got := reconnectDelay(failures); got != delay {
+			t.Errorf("delay after %d failures should be %v, got %v", failures, delay, got)
+		}
+	}
+}
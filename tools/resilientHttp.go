@@ -0,0 +1,207 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/averitas/courier_go/tools/logger"
+)
+
+type ResilientOptions struct {
+	// timeout of each try
+	Timeout time.Duration
+	// max retries after the first try
+	MaxRetries int
+	// backoff before retry n is random in [0, min(MaxBackoff, BaseBackoff * 2^n))
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// breaker of a target opens after these consecutive failures
+	BreakerThreshold int
+	// how long an open breaker rejects requests before trial
+	BreakerOpenDuration time.Duration
+}
+
+// ResilientHttpClient wrap HttpClient with per-request timeout, bounded retries with
+// jittered exponential backoff and a circuit breaker per target (scheme://host).
+// Only failures that are safe to retry are retried: dial errors, or transport
+// errors and 502/503/504 of idempotent requests.
+type ResilientHttpClient struct {
+	Client  HttpClient
+	Options ResilientOptions
+
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+func NewResilientHttpClient(client HttpClient, options ResilientOptions) *ResilientHttpClient {
+	return &ResilientHttpClient{
+		Client:   client,
+		Options:  options,
+		breakers: make(map[string]*CircuitBreaker),
+	}
+}
+
+func (c *ResilientHttpClient) Do(req *http.Request) (*http.Response, error) {
+	target := req.URL.Scheme + "://" + req.URL.Host
+	breaker := c.breaker(target)
+
+	var lastErr error
+	for try := 0; try <= c.Options.MaxRetries; try++ {
+		if try > 0 {
+			if err := c.backoff(req.Context(), try); err != nil {
+				return nil, err
+			}
+			if err := resetBody(req); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := breaker.Allow(); err != nil {
+			return nil, fmt.Errorf("call [%s] rejected: %v", target, err)
+		}
+
+		res, err := c.doOnce(req)
+		if !isFailure(res, err) {
+			breaker.Success()
+			return res, err
+		}
+		breaker.Failure()
+
+		if !canRetry(req, res, err) || try == c.Options.MaxRetries {
+			return res, err
+		}
+		if err != nil {
+			lastErr = err
+		} else {
+			lastErr = fmt.Errorf("got status %v", res.StatusCode)
+			if res.Body != nil {
+				res.Body.Close()
+			}
+		}
+		logger.WarningLogger.Printf("call [%s] try %d failed, retry: %v\n", req.URL.String(), try+1, lastErr)
+	}
+	return nil, lastErr
+}
+
+// BreakerStatus return status of all breakers sort by target
+func (c *ResilientHttpClient) BreakerStatus() []BreakerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res := make([]BreakerStatus, 0, len(c.breakers))
+	for target, breaker := range c.breakers {
+		res = append(res, breaker.Status(target))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Target < res[j].Target })
+	return res
+}
+
+func (c *ResilientHttpClient) breaker(target string) *CircuitBreaker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	breaker, ok := c.breakers[target]
+	if !ok {
+		breaker = NewCircuitBreaker(c.Options.BreakerThreshold, c.Options.BreakerOpenDuration)
+		c.breakers[target] = breaker
+	}
+	return breaker
+}
+
+func (c *ResilientHttpClient) doOnce(req *http.Request) (*http.Response, error) {
+	if c.Options.Timeout <= 0 {
+		return c.Client.Do(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), c.Options.Timeout)
+	res, err := c.Client.Do(req.WithContext(ctx))
+	if err != nil || res.Body == nil {
+		cancel()
+		return res, err
+	}
+	// timeout covers reading body as well, release it when body is closed
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+func (c *ResilientHttpClient) backoff(ctx context.Context, try int) error {
+	max := c.Options.BaseBackoff << (try - 1)
+	if max <= 0 || max > c.Options.MaxBackoff {
+		max = c.Options.MaxBackoff
+	}
+	if max <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(rand.Int63n(int64(max)))):
+		return nil
+	}
+}
+
+func resetBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if req.GetBody == nil {
+		return fmt.Errorf("request body of [%s] can't be replayed", req.URL.String())
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
+
+// courier is treated as failed if no response or server error
+func isFailure(res *http.Response, err error) bool {
+	return err != nil || res.StatusCode >= http.StatusInternalServerError
+}
+
+func canRetry(req *http.Request, res *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if err == nil && res.StatusCode != http.StatusBadGateway &&
+		res.StatusCode != http.StatusServiceUnavailable && res.StatusCode != http.StatusGatewayTimeout {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+
+	// request is not sent if dial failed
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return len(req.Header.Get("Idempotency-Key")) > 0
+	}
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,176 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// test server answers statuses in order, then 200
+type statusServer struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+}
+
+func (s *statusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	s.bodies = append(s.bodies, string(body))
+	status := http.StatusOK
+	if len(s.statuses) > 0 {
+		status, s.statuses = s.statuses[0], s.statuses[1:]
+	}
+	s.mu.Unlock()
+	w.WriteHeader(status)
+}
+
+func (s *statusServer) calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+func newTestResilientClient() *ResilientHttpClient {
+	return NewResilientHttpClient(http.DefaultClient, ResilientOptions{
+		Timeout:             time.Second,
+		MaxRetries:          3,
+		BaseBackoff:         time.Millisecond,
+		MaxBackoff:          5 * time.Millisecond,
+		BreakerThreshold:    100,
+		BreakerOpenDuration: time.Second,
+	})
+}
+
+func TestResilientHttpRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		key       string
+		body      string
+		wantCalls int
+		wantCode  int
+	}{
+		{"get is retried", http.MethodGet, "", "", 4, http.StatusOK},
+		{"post with key is retried with same body", http.MethodPost, "key1", `{"id":"1"}`, 4, http.StatusOK},
+		{"post without key is not retried", http.MethodPost, "", `{"id":"1"}`, 1, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &statusServer{statuses: []int{
+				http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout,
+			}}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			var body io.Reader
+			if len(tt.body) > 0 {
+				body = strings.NewReader(tt.body)
+			}
+			req, err := http.NewRequest(tt.method, server.URL, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.key) > 0 {
+				req.Header.Set("Idempotency-Key", tt.key)
+			}
+
+			res, err := newTestResilientClient().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.wantCode {
+				t.Errorf("expected status %d, got %d", tt.wantCode, res.StatusCode)
+			}
+			calls := handler.calls()
+			if len(calls) != tt.wantCalls {
+				t.Fatalf("expected %d calls, got %d", tt.wantCalls, len(calls))
+			}
+			for i, received := range calls {
+				if received != tt.body {
+					t.Errorf("call %d received body %q, expected %q", i+1, received, tt.body)
+				}
+			}
+		})
+	}
+}
+
+func TestResilientHttpNotReplayableBody(t *testing.T) {
+	handler := &statusServer{statuses: []int{http.StatusServiceUnavailable}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// body without GetBody can't be sent again
+	req, err := http.NewRequest(http.MethodPut, server.URL, io.NopCloser(strings.NewReader("abc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := newTestResilientClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable || len(handler.calls()) != 1 {
+		t.Errorf("expected single call got 503, got %d after %d calls", res.StatusCode, len(handler.calls()))
+	}
+}
+
+func TestResilientHttpTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	client := newTestResilientClient()
+	client.Options.Timeout = 50 * time.Millisecond
+	client.Options.MaxRetries = 0
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := client.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request should time out after 50ms, took %v", elapsed)
+	}
+}
+
+func TestResilientHttpBackoffCancelled(t *testing.T) {
+	handler := &statusServer{statuses: []int{http.StatusServiceUnavailable}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := newTestResilientClient()
+	client.Options.BaseBackoff = time.Hour
+	client.Options.MaxBackoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := client.Do(req); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("backoff should stop when ctx is cancelled, took %v", elapsed)
+	}
+	if len(handler.calls()) != 1 {
+		t.Errorf("expected no retry after cancel, got %d calls", len(handler.calls()))
+	}
+}
@@ -2,6 +2,11 @@ package types
 
 var (
 	QueueName = "OrderQueue"
+	// orders failed too many times are moved to dead letter queue
+	DeadLetterExchangeName = "OrderDeadLetterExchange"
+	DeadLetterQueueName    = "OrderDeadLetterQueue"
+	// fanout exchange to broadcast order cancellation to all workers
+	CancelExchangeName = "OrderCancelExchange"
 
 	CodeSuccess = 0
 	CodeFailed  = 0xFFFF
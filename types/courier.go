@@ -0,0 +1,23 @@
+package types
+
+import "time"
+
+// message that worker send to apiserver to register, heartbeat or deregister
+type CourierRegistration struct {
+	Url string `form:"url" json:"url" binding:"required"`
+	// max orders courier could cook at the same time, used by weighted dispatch
+	Capacity int `form:"capacity" json:"capacity"`
+}
+
+// courier info returned by apiserver
+type CourierInfo struct {
+	Url           string    `json:"url"`
+	Capacity      int       `json:"capacity"`
+	Static        bool      `json:"static"`
+	LastHeartbeat time.Time `json:"lastHeartbeat"`
+	// courier is skipped by dispatcher if it's unhealthy,
+	// until it answers health probe again
+	Healthy bool `json:"healthy"`
+	// consecutive failures of dispatch or probe
+	Failures int `json:"failures"`
+}
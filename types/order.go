@@ -1,15 +1,164 @@
 package types
 
+import "time"
+
 const (
 	OrderTypeFIFO  = "fifo"
 	OrderTypeMatch = "match"
 )
 
+const (
+	// priority of order is in [0, MaxPriority], larger is more urgent
+	MaxPriority = 9
+	// orders with at least this priority are sent to least loaded courier
+	HighPriority = 5
+)
+
 type Order struct {
-	Id   string `form:"id" json:"id" binding:"required"`
+	Id   string `form:"id" json:"id" binding:"required,max=191"`
 	Name string `form:"name" json:"name" binding:"required"`
 	// time in seconds
 	PrepTime int `form:"prepTime" json:"prepTime" binding:"required"`
+	// optional, 0 by default
+	Priority int `form:"priority" json:"priority,omitempty" binding:"min=0,max=9"`
+	// optional time the order should be cooked, it's dispatched PrepTime before it
+	ScheduledAt *time.Time `form:"scheduledAt" json:"scheduledAt,omitempty"`
 
 	OrderType string
 }
+
+// priority of queue message, see tools.Prioritized
+func (o *Order) MessagePriority() uint8 {
+	return uint8(o.Priority)
+}
+
+// high priority orders are dispatched to least loaded courier
+func (o *Order) IsHighPriority() bool {
+	return o.Priority >= HighPriority
+}
+
+// order detail returned by apiserver
+type OrderDetail struct {
+	OrderId   string `json:"orderId"`
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	OrderType string `json:"orderType"`
+	Status    string `json:"status"`
+	PrepTime  int    `json:"prepTime"`
+	Priority  int    `json:"priority"`
+	// set if order is scheduled
+	ScheduledAt *time.Time `json:"scheduledAt,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	// pickup delay in milliseconds, set once order is finished, listed orders only have it while still finished
+	PickupDelay *float64 `json:"pickupDelay,omitempty"`
+	// status transitions of order, only returned when querying single order
+	History []*OrderPhase `json:"history,omitempty"`
+}
+
+// an order status transition
+type OrderPhase struct {
+	Status string    `json:"status"`
+	At     time.Time `json:"at"`
+	Actor  string    `json:"actor"`
+	// milliseconds since previous transition
+	Duration float64 `json:"duration"`
+}
+
+// a page of orders returned by apiserver
+type OrderList struct {
+	Orders []*OrderDetail `json:"orders"`
+	// pass it as cursor to get next page, empty if no more orders
+	NextCursor string `json:"nextCursor"`
+}
+
+// average delay of order type, Code and Message are same as Message
+type DelayResult struct {
+	Code    int
+	Message string
+	// average delay in milliseconds of each priority
+	ByPriority map[int]float32 `json:"byPriority"`
+	// average time in milliseconds orders stayed in each status, by status name
+	ByPhase map[string]float32 `json:"byPhase"`
+}
+
+// name of time buckets to group delay statistics
+const (
+	GroupByMinute = "minute"
+	GroupByHour   = "hour"
+)
+
+// pickup delay statistics of orders have been finished in milliseconds
+type DelayStats struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean"`
+	// exact nearest-rank percentiles
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+	// count of orders in each bucket from the smallest delay
+	Histogram []*DelayBucket `json:"histogram"`
+}
+
+// orders with delay greater than Le of previous bucket and at most Le,
+// Le of the last bucket is null for unbounded
+type DelayBucket struct {
+	Le    *float64 `json:"le"`
+	Count int      `json:"count"`
+}
+
+// delay statistics of orders finished in [Start, Start + groupBy)
+type DelayGroup struct {
+	Start time.Time `json:"start"`
+	DelayStats
+}
+
+// delay statistics of order type finished in [From, To)
+type DelayStatsResult struct {
+	OrderType string     `json:"orderType"`
+	From      *time.Time `json:"from,omitempty"`
+	To        *time.Time `json:"to,omitempty"`
+	GroupBy   string     `json:"groupBy,omitempty"`
+	DelayStats
+	// statistics of each time bucket ordered by Start, only set with GroupBy
+	Groups []*DelayGroup `json:"groups,omitempty"`
+}
+
+// message to cancel an order, sent to workers
+type CancelOrder struct {
+	Id string `json:"id"`
+}
+
+// error code of order rejected in submitted batch
+const (
+	// order is malformed or failed validation, it won't be accepted by retry
+	OrderErrInvalid = "invalid_order"
+	// order couldn't be saved, it could be retried
+	OrderErrSave = "save_failed"
+	// no courier or queue accepted the order, it's moved to failed and
+	// dispatched again if it's submitted again with the same id
+	OrderErrDispatch = "dispatch_failed"
+)
+
+// result of an order in submitted batch
+type OrderResult struct {
+	Id string `json:"id"`
+	// empty if order isn't saved
+	OrderId string `json:"orderId,omitempty"`
+	Status  string `json:"status,omitempty"`
+	// order with same id was submitted before, existing order is returned
+	// and it's dispatched again only if it never was
+	Duplicate bool `json:"duplicate"`
+	Accepted  bool `json:"accepted"`
+	// set if order isn't accepted
+	ErrorCode string `json:"errorCode,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// response of order submission, Code and Message are same as Message
+type SubmitResult struct {
+	Code    int
+	Message string
+	Orders  []*OrderResult `json:"orders"`
+}